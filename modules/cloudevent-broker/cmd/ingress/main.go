@@ -20,6 +20,7 @@ import (
 
 	"github.com/chainguard-dev/clog"
 	_ "github.com/chainguard-dev/clog/gcp/init"
+	"github.com/chainguard-dev/terraform-infra-common/pkg/httpmetrics"
 	cgpubsub "github.com/chainguard-dev/terraform-infra-common/pkg/pubsub"
 )
 
@@ -42,6 +43,13 @@ func main() {
 		clog.Fatalf("failed to process env var: %s", err)
 	}
 
+	ready := httpmetrics.AddReadinessGate("cloudevents-client")
+	go func() {
+		if err := httpmetrics.ServeMetricsContext(ctx); err != nil {
+			clog.Errorf("ServeMetricsContext() = %v", err)
+		}
+	}()
+
 	c, err := cloudevents.NewClientHTTP(cloudevents.WithPort(env.Port))
 	if err != nil {
 		clog.Fatalf("failed to create CE client, %v", err)
@@ -58,6 +66,7 @@ func main() {
 
 	topic := psc.Topic(env.Topic)
 	defer topic.Stop()
+	ready()
 
 	if err := c.StartReceiver(cloudevents.ContextWithRetriesExponentialBackoff(ctx, retryDelay, maxRetry), func(ctx context.Context, event cloudevents.Event) {
 		res := topic.Publish(ctx, cgpubsub.FromCloudEvent(ctx, event))
@@ -10,9 +10,12 @@ module "used" {
   filter = concat(var.filter, [
     "metric.type=\"prometheus.googleapis.com/github_rate_limit_used/gauge\"",
   ])
-  group_by_fields = ["resource.label.\"resource\""]
-  primary_align   = "ALIGN_MAX"
-  primary_reduce  = "REDUCE_SUM"
+  group_by_fields = [
+    "metric.label.\"host\"",
+    "metric.label.\"resource\"",
+  ]
+  primary_align  = "ALIGN_MAX"
+  primary_reduce = "REDUCE_SUM"
 }
 
 module "limit" {
@@ -21,9 +24,12 @@ module "limit" {
   filter = concat(var.filter, [
     "metric.type=\"prometheus.googleapis.com/github_rate_limit/gauge\"",
   ])
-  group_by_fields = ["resource.label.\"resource\""]
-  primary_align   = "ALIGN_MAX"
-  primary_reduce  = "REDUCE_MEAN"
+  group_by_fields = [
+    "metric.label.\"host\"",
+    "metric.label.\"resource\"",
+  ]
+  primary_align  = "ALIGN_MAX"
+  primary_reduce = "REDUCE_MEAN"
 }
 
 module "time_to_reset" {
@@ -32,9 +38,12 @@ module "time_to_reset" {
   filter = concat(var.filter, [
     "metric.type=\"prometheus.googleapis.com/github_rate_limit_time_to_reset/gauge\"",
   ])
-  group_by_fields = ["resource.label.\"resource\""]
-  primary_align   = "ALIGN_MAX"
-  primary_reduce  = "REDUCE_MEAN"
+  group_by_fields = [
+    "metric.label.\"host\"",
+    "metric.label.\"resource\"",
+  ]
+  primary_align  = "ALIGN_MAX"
+  primary_reduce = "REDUCE_MEAN"
 }
 
 locals {
@@ -40,16 +40,27 @@ func main() {
 	defer cancel()
 	log := clog.FromContext(ctx)
 
+	ready := httpmetrics.AddReadinessGate("cloudevents-client")
+	go func() {
+		if err := httpmetrics.ServeMetricsContext(ctx); err != nil {
+			log.Errorf("ServeMetricsContext() = %v", err)
+		}
+	}()
+
 	c, err := idtoken.NewClient(ctx, env.IngressURI)
 	if err != nil {
 		log.Fatalf("failed to create idtoken client: %v", err) //nolint:gocritic
 	}
 	ceclient, err := cloudevents.NewClientHTTP(
 		cloudevents.WithTarget(env.IngressURI),
-		cehttp.WithClient(http.Client{Transport: httpmetrics.WrapTransport(c.Transport)}))
+		cehttp.WithClient(http.Client{Transport: httpmetrics.WrapTransport(c.Transport, httpmetrics.WithCloudEventsRetries(
+			httpmetrics.WithMaxRetries(3),
+			httpmetrics.WithRetryBackoff(10*time.Millisecond, time.Second),
+		))}))
 	if err != nil {
 		log.Fatalf("failed to create cloudevents client: %v", err)
 	}
+	ready()
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -95,10 +106,8 @@ func main() {
 			return
 		}
 
-		const retryDelay = 10 * time.Millisecond
-		const maxRetry = 3
-		rctx := cloudevents.ContextWithRetriesExponentialBackoff(context.WithoutCancel(ctx), retryDelay, maxRetry)
-		if ceresult := ceclient.Send(rctx, event); cloudevents.IsUndelivered(ceresult) || cloudevents.IsNACK(ceresult) {
+		// The transport retries the delivery, see httpmetrics.WithCloudEventsRetries.
+		if ceresult := ceclient.Send(context.WithoutCancel(ctx), event); cloudevents.IsUndelivered(ceresult) || cloudevents.IsNACK(ceresult) {
 			log.Errorf("Failed to deliver event: %v", ceresult)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
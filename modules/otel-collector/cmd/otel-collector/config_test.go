@@ -0,0 +1,51 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestConfigReceivesOTLP(t *testing.T) {
+	b, err := os.ReadFile("kodata/config.yaml")
+	if err != nil {
+		t.Fatalf("ReadFile() = %v", err)
+	}
+	var cfg struct {
+		Receivers struct {
+			OTLP struct {
+				Protocols struct {
+					HTTP struct {
+						Endpoint string `yaml:"endpoint"`
+					} `yaml:"http"`
+				} `yaml:"protocols"`
+			} `yaml:"otlp"`
+		} `yaml:"receivers"`
+		Service struct {
+			Pipelines struct {
+				Metrics struct {
+					Receivers []string `yaml:"receivers"`
+				} `yaml:"metrics"`
+			} `yaml:"pipelines"`
+		} `yaml:"service"`
+	}
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		t.Fatalf("Unmarshal() = %v", err)
+	}
+
+	// httpmetrics.SetupMeter and FlushMetrics export to the default endpoint
+	// of the OTLP/HTTP exporter, unless OTEL_EXPORTER_OTLP_ENDPOINT is set.
+	if got, want := cfg.Receivers.OTLP.Protocols.HTTP.Endpoint, "localhost:4318"; got != want {
+		t.Errorf("otlp http endpoint = %q, want %q", got, want)
+	}
+	if got := cfg.Service.Pipelines.Metrics.Receivers; !slices.Contains(got, "otlp") || !slices.Contains(got, "prometheus") {
+		t.Errorf("metrics receivers = %v, want otlp and prometheus", got)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+)
+
+// CeIDHeader is the header of the ID of binary mode CloudEvents.
+const CeIDHeader = "ce-id"
+
+// AccessLogOption configures the access log added by WithAccessLog.
+type AccessLogOption func(*accessLogConfig)
+
+type accessLogConfig struct {
+	fraction float64
+	excluded []string
+}
+
+// WithAccessLogSampling logs only a fraction of the requests that don't
+// fail with a 5xx, which are always logged.
+func WithAccessLogSampling(fraction float64) AccessLogOption {
+	return func(c *accessLogConfig) { c.fraction = fraction }
+}
+
+// WithAccessLogExcludedPaths never logs the requests to the paths, e.g.
+// health checks.
+func WithAccessLogExcludedPaths(paths ...string) AccessLogOption {
+	return func(c *accessLogConfig) { c.excluded = append(c.excluded, paths...) }
+}
+
+// WithAccessLog makes Handler write a line to the clog logger of the
+// request for each request it serves, with the httpRequest structure that
+// Cloud Logging displays as a request log, and the type and ID of the
+// CloudEvent. Requests that fail with a 5xx are logged as errors, and those
+// that fail with a 4xx as warnings.
+// See https://cloud.google.com/logging/docs/reference/v2/rest/v2/LogEntry#HttpRequest
+func WithAccessLog(opts ...AccessLogOption) HandlerOption {
+	cfg := accessLogConfig{fraction: 1}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return func(c *handlerConfig) { c.accessLog = &cfg }
+}
+
+func accessLog(cfg *accessLogConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(cfg.excluded, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rw := &recordingWriter{ResponseWriter: w}
+		var body *countingBody
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &countingBody{ReadCloser: r.Body, done: func(int64) {}}
+			rc := new(http.Request)
+			*rc = *r
+			rc.Body = body
+			r = rc
+		}
+		next.ServeHTTP(rw, r)
+		latency := time.Since(start)
+
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		if level != slog.LevelError && cfg.fraction < 1 && rand.Float64() >= cfg.fraction { //nolint:gosec
+			return
+		}
+
+		var requestSize int64
+		if body != nil {
+			requestSize = body.n.Load()
+		}
+		scheme := "http"
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		ctx := r.Context()
+		clog.FromContext(ctx).Log(ctx, level, fmt.Sprintf("%s %s %d", r.Method, r.URL.Path, status),
+			slog.Group("httpRequest",
+				"requestMethod", r.Method,
+				"requestUrl", scheme+"://"+r.Host+r.URL.RequestURI(),
+				"requestSize", strconv.FormatInt(requestSize, 10),
+				"status", status,
+				"responseSize", strconv.FormatInt(rw.size, 10),
+				"userAgent", r.UserAgent(),
+				"remoteIp", remoteIP(r),
+				"referer", r.Referer(),
+				"latency", fmt.Sprintf("%.9fs", latency.Seconds()),
+				"protocol", r.Proto,
+			),
+			"ce_type", r.Header.Get(CeTypeHeader),
+			"ce_id", r.Header.Get(CeIDHeader),
+		)
+	})
+}
+
+// remoteIP returns the IP of the client, which is the first hop of
+// X-Forwarded-For behind Cloud Run's load balancer.
+func remoteIP(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		ip, _, _ := strings.Cut(xff, ",")
+		return strings.TrimSpace(ip)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
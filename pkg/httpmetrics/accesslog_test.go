@@ -0,0 +1,111 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAccessLog(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body) //nolint:errcheck
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		io.WriteString(w, "hello") //nolint:errcheck
+	})
+
+	// serve returns the lines logged while serving a request.
+	serve := func(h http.Handler, path string) []map[string]any {
+		var buf bytes.Buffer
+		ctx := clog.WithLogger(context.Background(), clog.New(slog.NewJSONHandler(&buf, nil)))
+		req := httptest.NewRequest(http.MethodPost, "http://example.com"+path+"?x=1", strings.NewReader("request")).WithContext(ctx)
+		req.Header.Set("User-Agent", "test-agent")
+		req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+		req.Header.Set(CeTypeHeader, "dev.chainguard.test")
+		req.Header.Set(CeIDHeader, "1234")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		var lines []map[string]any
+		for _, l := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+			if len(l) == 0 {
+				continue
+			}
+			var line map[string]any
+			if err := json.Unmarshal(l, &line); err != nil {
+				t.Fatalf("Unmarshal(%s) = %v", l, err)
+			}
+			lines = append(lines, line)
+		}
+		return lines
+	}
+
+	t.Run("logged", func(t *testing.T) {
+		lines := serve(m.Handler("access", handler, WithAccessLog()), "/ok")
+		if len(lines) != 1 {
+			t.Fatalf("got %d lines, want 1", len(lines))
+		}
+		line := lines[0]
+		req, ok := line["httpRequest"].(map[string]any)
+		if !ok {
+			t.Fatalf("httpRequest = %v", line["httpRequest"])
+		}
+		if _, ok := req["latency"].(string); !ok {
+			t.Errorf("latency = %v, want a duration", req["latency"])
+		}
+		delete(req, "latency")
+		if diff := cmp.Diff(map[string]any{
+			"requestMethod": "POST",
+			"requestUrl":    "http://example.com/ok?x=1",
+			"requestSize":   "7",
+			"status":        float64(200),
+			"responseSize":  "5",
+			"userAgent":     "test-agent",
+			"remoteIp":      "203.0.113.7",
+			"referer":       "",
+			"protocol":      "HTTP/1.1",
+		}, req); diff != "" {
+			t.Errorf("httpRequest (-want +got): %s", diff)
+		}
+		if line["level"] != "INFO" || line["msg"] != "POST /ok 200" || line["ce_type"] != "dev.chainguard.test" || line["ce_id"] != "1234" {
+			t.Errorf("line = %v", line)
+		}
+	})
+
+	t.Run("excluded", func(t *testing.T) {
+		if lines := serve(m.Handler("access", handler, WithAccessLog(WithAccessLogExcludedPaths("/ok"))), "/ok"); len(lines) != 0 {
+			t.Errorf("got %v, want no lines", lines)
+		}
+	})
+
+	t.Run("sampled", func(t *testing.T) {
+		h := m.Handler("access", handler, WithAccessLog(WithAccessLogSampling(0)))
+		if lines := serve(h, "/ok"); len(lines) != 0 {
+			t.Errorf("got %v, want no lines", lines)
+		}
+		// Failures are always logged.
+		lines := serve(h, "/fail")
+		if len(lines) != 1 || lines[0]["level"] != "ERROR" {
+			t.Errorf("got %v, want an error", lines)
+		}
+	})
+}
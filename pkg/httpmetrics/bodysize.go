@@ -0,0 +1,118 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func (m *Metrics) newSizeCollectors() {
+	m.mReqBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_client_request_bytes_total",
+			Help: "The total number of bytes sent in the bodies of HTTP requests",
+		},
+		[]string{"method", "host", "service_name", "configuration_name", "revision_name", "ce_type"},
+	)
+	m.mRespBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_client_response_bytes_total",
+			Help: "The total number of bytes read from the bodies of HTTP responses",
+		},
+		[]string{"code", "method", "host", "service_name", "configuration_name", "revision_name", "ce_type"},
+	)
+}
+
+// instrumentRoundTripperSize records the sizes of the request and response
+// bodies. Since bodies are streamed, they are counted as they are read, and
+// recorded once they reach EOF or are closed, whichever comes first: a
+// response body closed early records what was read of it. Request bodies
+// are closed by the transport, even when the request fails.
+func (m *Metrics) instrumentRoundTripperSize(b *HostBucketer, next http.RoundTripper) promhttp.RoundTripperFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		m.mustInitHistograms()
+		ctx := r.Context()
+		labels := prometheus.Labels{
+			"method":             r.Method,
+			"host":               b.Bucket(r.URL.Host),
+			"service_name":       env.KnativeServiceName,
+			"configuration_name": env.KnativeConfigurationName,
+			"revision_name":      env.KnativeRevisionName,
+			"ce_type":            r.Header.Get(CeTypeHeader),
+		}
+		observeRequest := func(n int64) {
+			observeWithExemplar(ctx, m.mReqSize.With(labels), float64(n))
+			m.mReqBytes.With(labels).Add(float64(n))
+		}
+		if r.Body == nil || r.Body == http.NoBody {
+			observeRequest(0)
+		} else {
+			// RoundTrippers must not modify the request, so send a copy.
+			// Replacing NoBody would have changed how it is sent.
+			rc := new(http.Request)
+			*rc = *r
+			rc.Body = &countingBody{ReadCloser: r.Body, done: observeRequest}
+			r = rc
+		}
+
+		resp, err := next.RoundTrip(r)
+		if err != nil {
+			return resp, err
+		}
+		respLabels := prometheus.Labels{"code": fmt.Sprintf("%d", resp.StatusCode)}
+		for k, v := range labels {
+			respLabels[k] = v
+		}
+		observeResponse := func(n int64) {
+			observeWithExemplar(ctx, m.mRespSize.With(respLabels), float64(n))
+			m.mRespBytes.With(respLabels).Add(float64(n))
+		}
+		switch resp.Body.(type) {
+		case nil:
+			observeResponse(0)
+		case io.Writer:
+			// The body of a 101 Switching Protocols response is the
+			// connection, which callers type assert to write to it.
+		default:
+			resp.Body = &countingBody{ReadCloser: resp.Body, done: observeResponse}
+		}
+		return resp, err
+	}
+}
+
+// countingBody counts the bytes read from a body, and calls done with the
+// count on EOF or Close, whichever comes first.
+type countingBody struct {
+	io.ReadCloser
+	n    atomic.Int64
+	once sync.Once
+	done func(n int64)
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	if err == io.EOF {
+		b.record()
+	}
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	b.record()
+	return b.ReadCloser.Close()
+}
+
+func (b *countingBody) record() {
+	b.once.Do(func() { b.done(b.n.Load()) })
+}
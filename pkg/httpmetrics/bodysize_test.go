@@ -0,0 +1,117 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestBodySizes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			t.Errorf("reading request body: %v", err)
+		}
+		// Larger than the transport buffers, so that an early close
+		// leaves most of it unread.
+		io.WriteString(w, strings.Repeat("x", 1<<20)) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	for _, c := range []struct {
+		name     string
+		body     io.Reader
+		read     int64
+		wantReq  float64
+		wantResp float64
+	}{{
+		name:     "no body",
+		read:     -1,
+		wantResp: 1 << 20,
+	}, {
+		name:     "sized body",
+		body:     strings.NewReader(strings.Repeat("y", 1000)),
+		read:     -1,
+		wantReq:  1000,
+		wantResp: 1 << 20,
+	}, {
+		// Without a length, the request is sent chunked.
+		name:     "streamed body",
+		body:     io.MultiReader(strings.NewReader("hello "), strings.NewReader("world")),
+		read:     -1,
+		wantReq:  11,
+		wantResp: 1 << 20,
+	}, {
+		name:     "closed before EOF",
+		read:     10,
+		wantResp: 10,
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			m, err := NewMetrics(prometheus.NewRegistry())
+			if err != nil {
+				t.Fatalf("NewMetrics() = %v", err)
+			}
+			client := &http.Client{Transport: m.WrapTransport(http.DefaultTransport)}
+			req, err := http.NewRequest(http.MethodPost, srv.URL, c.body)
+			if err != nil {
+				t.Fatalf("NewRequest() = %v", err)
+			}
+			req.Header.Set(CeTypeHeader, "dev.chainguard.test")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Do() = %v", err)
+			}
+			if c.read < 0 {
+				_, err = io.Copy(io.Discard, resp.Body)
+			} else {
+				_, err = io.CopyN(io.Discard, resp.Body, c.read)
+			}
+			if err != nil {
+				t.Fatalf("reading response body: %v", err)
+			}
+			resp.Body.Close()
+
+			if got := testutil.ToFloat64(m.mReqBytes); got != c.wantReq {
+				t.Errorf("http_client_request_bytes_total = %v, want %v", got, c.wantReq)
+			}
+			if got := testutil.ToFloat64(m.mRespBytes); got != c.wantResp {
+				t.Errorf("http_client_response_bytes_total = %v, want %v", got, c.wantResp)
+			}
+			// Each body is recorded once, even though it is both read to EOF
+			// and closed.
+			for name, h := range map[string]*prometheus.HistogramVec{
+				"http_client_request_size_bytes":  m.mReqSize,
+				"http_client_response_size_bytes": m.mRespSize,
+			} {
+				if got := testutil.CollectAndCount(h); got != 1 {
+					t.Errorf("%s series = %d, want 1", name, got)
+				}
+			}
+			if got := sampleCount(t, m.mRespSize); got != 1 {
+				t.Errorf("http_client_response_size_bytes count = %d, want 1", got)
+			}
+		})
+	}
+}
+
+// sampleCount returns the number of observations of the only series of h.
+func sampleCount(t *testing.T, h *prometheus.HistogramVec) uint64 {
+	t.Helper()
+	ch := make(chan prometheus.Metric, 1)
+	h.Collect(ch)
+	var pb dto.Metric
+	if err := (<-ch).Write(&pb); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	return pb.GetHistogram().GetSampleCount()
+}
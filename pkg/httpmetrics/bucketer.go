@@ -0,0 +1,372 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+// HostBucketRuleKind is the way a HostBucketRule matches hosts.
+type HostBucketRuleKind string
+
+const (
+	// RuleExact matches the host exactly.
+	RuleExact HostBucketRuleKind = "exact"
+	// RuleSuffix matches subdomains of the pattern, but not the pattern itself.
+	RuleSuffix HostBucketRuleKind = "suffix"
+	// RuleGlob matches the host with path.Match, e.g. "*.gcr.io".
+	RuleGlob HostBucketRuleKind = "glob"
+	// RuleRegexp matches the host against a regular expression. The bucket
+	// may refer to submatches, e.g. "$1", as in regexp.Regexp.Expand.
+	RuleRegexp HostBucketRuleKind = "regex"
+)
+
+// otherBucket is the bucket for hosts that don't match any rule.
+const otherBucket = "other"
+
+// HostBucketRule maps the hosts matching Pattern onto Bucket.
+type HostBucketRule struct {
+	Kind    HostBucketRuleKind
+	Pattern string
+	Bucket  string
+}
+
+// DefaultMaxBuckets is the default cap on the number of distinct buckets a
+// HostBucketer returns, beyond which hosts are bucketed as "other".
+const DefaultMaxBuckets = 100
+
+// warnInterval is how often we warn about any one host bucketed as "other".
+const warnInterval = time.Minute
+
+// maxWarnedHosts bounds the memory used to rate-limit warnings.
+const maxWarnedHosts = 1000
+
+// HostBucketer maps request hosts onto a bounded set of values for the
+// "host" label of the client metrics. It is safe for concurrent use.
+//
+// Rules are checked by kind: exact matches first, then suffixes (longest
+// first), then globs and regular expressions in the order given. Hosts are
+// matched without their port, except that exact rules may include one.
+type HostBucketer struct {
+	rules      atomic.Pointer[ruleSet]
+	maxBuckets int
+
+	// rulesMu serializes the updates of the rules, apart from mu, which
+	// Bucket takes for every request.
+	rulesMu sync.Mutex
+
+	mu     sync.RWMutex
+	issued map[string]struct{}
+	warned map[string]time.Time
+}
+
+// HostBucketerOption configures a HostBucketer.
+type HostBucketerOption func(*HostBucketer)
+
+// WithMaxBuckets caps the number of distinct buckets, which matters when
+// regular expression rules expand submatches.
+func WithMaxBuckets(n int) HostBucketerOption {
+	return func(b *HostBucketer) { b.maxBuckets = n }
+}
+
+// NewHostBucketer returns a HostBucketer with the given rules.
+func NewHostBucketer(rules []HostBucketRule, opts ...HostBucketerOption) (*HostBucketer, error) {
+	b := &HostBucketer{
+		maxBuckets: DefaultMaxBuckets,
+		issued:     map[string]struct{}{},
+		warned:     map[string]time.Time{},
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if err := b.SetRules(rules...); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// HostBucketerFromEnv returns a HostBucketer with the rules from the
+// HTTP_CLIENT_HOST_BUCKETS environment variable, followed by those from the
+// file named by HTTP_CLIENT_HOST_BUCKETS_FILE. See ParseHostBucketRules for
+// the format; in the environment variable, rules may also be separated by
+// semicolons, and a semicolon within a rule must be escaped as \;.
+func HostBucketerFromEnv(opts ...HostBucketerOption) (*HostBucketer, error) {
+	var env struct {
+		Rules string `envconfig:"HTTP_CLIENT_HOST_BUCKETS"`
+		File  string `envconfig:"HTTP_CLIENT_HOST_BUCKETS_FILE"`
+	}
+	if err := envconfig.Process("", &env); err != nil {
+		return nil, err
+	}
+	rules, err := ParseHostBucketRules(strings.NewReader(splitEnvRules(env.Rules)))
+	if err != nil {
+		return nil, fmt.Errorf("parsing HTTP_CLIENT_HOST_BUCKETS: %w", err)
+	}
+	if env.File != "" {
+		f, err := os.Open(env.File)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		fileRules, err := ParseHostBucketRules(f)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", env.File, err)
+		}
+		rules = append(rules, fileRules...)
+	}
+	return NewHostBucketer(rules, opts...)
+}
+
+// splitEnvRules puts the rules separated by unescaped semicolons on lines of
+// their own, and unescapes the others.
+func splitEnvRules(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == ';':
+			sb.WriteByte(';')
+			i++
+		case s[i] == ';':
+			sb.WriteByte('\n')
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
+
+// ParseHostBucketRules parses one rule per line, of the form:
+//
+//	<kind>:<pattern>=<bucket>
+//
+// for example:
+//
+//	exact:api.github.com=GH API
+//	suffix:googleapis.com=Google API
+//	glob:*.gcr.io=GCR
+//	regex:^([a-z0-9-]+)\.a\.run\.app$=Cloud Run $1
+//
+// Blank lines and lines starting with # are ignored.
+func ParseHostBucketRules(r io.Reader) ([]HostBucketRule, error) {
+	var rules []HostBucketRule
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kind, rest, ok := strings.Cut(line, ":")
+		i := strings.LastIndex(rest, "=")
+		if !ok || i < 0 {
+			return nil, fmt.Errorf("malformed host bucket rule %q, want <kind>:<pattern>=<bucket>", line)
+		}
+		rules = append(rules, HostBucketRule{
+			Kind:    HostBucketRuleKind(strings.TrimSpace(kind)),
+			Pattern: strings.TrimSpace(rest[:i]),
+			Bucket:  strings.TrimSpace(rest[i+1:]),
+		})
+	}
+	return rules, s.Err()
+}
+
+// SetRules atomically replaces the rules of the HostBucketer.
+func (b *HostBucketer) SetRules(rules ...HostBucketRule) error {
+	b.rulesMu.Lock()
+	defer b.rulesMu.Unlock()
+	return b.setRulesLocked(rules)
+}
+
+func (b *HostBucketer) setRulesLocked(rules []HostBucketRule) error {
+	rs, err := compileRules(rules)
+	if err != nil {
+		return err
+	}
+	b.rules.Store(rs)
+	return nil
+}
+
+// replaceKind replaces the rules of one kind with those in the map, keeping
+// the rest.
+func (b *HostBucketer) replaceKind(kind HostBucketRuleKind, m map[string]string) error {
+	b.rulesMu.Lock()
+	defer b.rulesMu.Unlock()
+	var rules []HostBucketRule
+	for _, r := range b.Rules() {
+		if r.Kind != kind {
+			rules = append(rules, r)
+		}
+	}
+	patterns := make([]string, 0, len(m))
+	for p := range m {
+		patterns = append(patterns, p)
+	}
+	sort.Strings(patterns)
+	for _, p := range patterns {
+		rules = append(rules, HostBucketRule{Kind: kind, Pattern: p, Bucket: m[p]})
+	}
+	return b.setRulesLocked(rules)
+}
+
+// Rules returns the current rules of the HostBucketer.
+func (b *HostBucketer) Rules() []HostBucketRule {
+	return slices.Clone(b.rules.Load().rules)
+}
+
+// Bucket returns the bucket for the host, or "other".
+func (b *HostBucketer) Bucket(host string) string {
+	bucket, ok := b.rules.Load().match(host)
+	if !ok {
+		b.warnOther(host)
+		return otherBucket
+	}
+
+	b.mu.RLock()
+	_, ok = b.issued[bucket]
+	b.mu.RUnlock()
+	if ok {
+		return bucket
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.issued[bucket]; !ok {
+		if len(b.issued) >= b.maxBuckets {
+			b.warnLocked(host, "bucketing host as \"other\", too many distinct host buckets", "bucket", bucket, "max", b.maxBuckets)
+			return otherBucket
+		}
+		b.issued[bucket] = struct{}{}
+	}
+	return bucket
+}
+
+func (b *HostBucketer) warnOther(host string) {
+	// Bucket is called several times for each request, so only take the
+	// write lock when a warning is due.
+	b.mu.RLock()
+	last, ok := b.warned[host]
+	b.mu.RUnlock()
+	if ok && time.Since(last) < warnInterval {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.warnLocked(host, `bucketing host as "other", use httpmetrics.SetBucket{Suffixe}s or HTTP_CLIENT_HOST_BUCKETS`)
+}
+
+func (b *HostBucketer) warnLocked(host, msg string, args ...any) {
+	now := time.Now()
+	if last, ok := b.warned[host]; ok && now.Sub(last) < warnInterval {
+		return
+	}
+	if len(b.warned) >= maxWarnedHosts {
+		clear(b.warned)
+	}
+	b.warned[host] = now
+	slog.Warn(msg, append([]any{"host", host}, args...)...)
+}
+
+type suffixRule struct {
+	suffix, bucket string
+}
+
+type globRule struct {
+	pattern, bucket string
+}
+
+type regexpRule struct {
+	re     *regexp.Regexp
+	bucket string
+}
+
+// ruleSet is an immutable, compiled set of rules.
+type ruleSet struct {
+	rules    []HostBucketRule
+	exact    map[string]string
+	suffixes []suffixRule
+	globs    []globRule
+	regexps  []regexpRule
+}
+
+func compileRules(rules []HostBucketRule) (*ruleSet, error) {
+	rs := &ruleSet{
+		rules: rules,
+		exact: make(map[string]string, len(rules)),
+	}
+	for _, r := range rules {
+		switch r.Kind {
+		case RuleExact:
+			rs.exact[strings.ToLower(r.Pattern)] = r.Bucket
+		case RuleSuffix:
+			rs.suffixes = append(rs.suffixes, suffixRule{
+				suffix: "." + strings.TrimPrefix(strings.ToLower(r.Pattern), "."),
+				bucket: r.Bucket,
+			})
+		case RuleGlob:
+			if _, err := path.Match(r.Pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid glob %q: %w", r.Pattern, err)
+			}
+			rs.globs = append(rs.globs, globRule{pattern: strings.ToLower(r.Pattern), bucket: r.Bucket})
+		case RuleRegexp:
+			re, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex %q: %w", r.Pattern, err)
+			}
+			rs.regexps = append(rs.regexps, regexpRule{re: re, bucket: r.Bucket})
+		default:
+			return nil, fmt.Errorf("unknown host bucket rule kind %q", r.Kind)
+		}
+	}
+	// The most specific suffix wins.
+	sort.SliceStable(rs.suffixes, func(i, j int) bool {
+		return len(rs.suffixes[i].suffix) > len(rs.suffixes[j].suffix)
+	})
+	return rs, nil
+}
+
+func (rs *ruleSet) match(host string) (string, bool) {
+	host = strings.ToLower(host)
+	if b, ok := rs.exact[host]; ok {
+		return b, true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+		if b, ok := rs.exact[host]; ok {
+			return b, true
+		}
+	}
+	for _, s := range rs.suffixes {
+		if strings.HasSuffix(host, s.suffix) {
+			return s.bucket, true
+		}
+	}
+	for _, g := range rs.globs {
+		if ok, _ := path.Match(g.pattern, host); ok {
+			return g.bucket, true
+		}
+	}
+	for _, r := range rs.regexps {
+		if m := r.re.FindStringSubmatchIndex(host); m != nil {
+			return string(r.re.ExpandString(nil, r.bucket, host, m)), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHostBucketer(t *testing.T) {
+	b, err := NewHostBucketer([]HostBucketRule{
+		{Kind: RuleExact, Pattern: "api.github.com", Bucket: "GH API"},
+		{Kind: RuleExact, Pattern: "localhost:8080", Bucket: "local"},
+		{Kind: RuleSuffix, Pattern: "googleapis.com", Bucket: "Google API"},
+		{Kind: RuleSuffix, Pattern: "storage.googleapis.com", Bucket: "GCS"},
+		{Kind: RuleGlob, Pattern: "*.gcr.io", Bucket: "GCR"},
+		{Kind: RuleGlob, Pattern: "*-docker.pkg.dev", Bucket: "AR"},
+		{Kind: RuleRegexp, Pattern: `^([a-z0-9-]+)-[a-z0-9]+-[a-z]{2}\.a\.run\.app$`, Bucket: "Cloud Run $1"},
+	})
+	if err != nil {
+		t.Fatalf("NewHostBucketer() = %v", err)
+	}
+	for _, c := range []struct{ host, bucket string }{
+		{"api.github.com", "GH API"},
+		{"API.GitHub.com", "GH API"},
+		{"api.github.com:443", "GH API"},
+		{"localhost:8080", "local"},
+		{"localhost", "other"},
+		{"compute.googleapis.com", "Google API"},
+		{"foo.storage.googleapis.com", "GCS"},
+		{"googleapis.com", "other"},
+		{"us.gcr.io", "GCR"},
+		{"gcr.io", "other"},
+		{"us-central1-docker.pkg.dev", "AR"},
+		{"ingress-abc123def-uc.a.run.app", "Cloud Run ingress"},
+		{"a.run.app", "other"},
+	} {
+		if got := b.Bucket(c.host); got != c.bucket {
+			t.Errorf("Bucket(%q) = %q, want %q", c.host, got, c.bucket)
+		}
+	}
+}
+
+func TestHostBucketerMaxBuckets(t *testing.T) {
+	b, err := NewHostBucketer([]HostBucketRule{
+		{Kind: RuleRegexp, Pattern: `^(.*)\.example\.com$`, Bucket: "$1"},
+	}, WithMaxBuckets(2))
+	if err != nil {
+		t.Fatalf("NewHostBucketer() = %v", err)
+	}
+	for _, c := range []struct{ host, bucket string }{
+		{"a.example.com", "a"},
+		{"b.example.com", "b"},
+		{"c.example.com", "other"},
+		{"a.example.com", "a"},
+	} {
+		if got := b.Bucket(c.host); got != c.bucket {
+			t.Errorf("Bucket(%q) = %q, want %q", c.host, got, c.bucket)
+		}
+	}
+}
+
+func TestHostBucketerConcurrent(t *testing.T) {
+	b, err := NewHostBucketer(nil)
+	if err != nil {
+		t.Fatalf("NewHostBucketer() = %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				b.Bucket(fmt.Sprintf("host-%d.example.com", j))
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			if err := b.replaceKind(RuleExact, map[string]string{"api.github.com": fmt.Sprint(i)}); err != nil {
+				t.Errorf("replaceKind() = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestHostBucketerConcurrentSetRules(t *testing.T) {
+	b, err := NewHostBucketer(nil)
+	if err != nil {
+		t.Fatalf("NewHostBucketer() = %v", err)
+	}
+	glob := HostBucketRule{Kind: RuleGlob, Pattern: "*.gcr.io", Bucket: "GCR"}
+	for i := 0; i < 100; i++ {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := b.SetRules(glob); err != nil {
+				t.Errorf("SetRules() = %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := b.replaceKind(RuleExact, map[string]string{"api.github.com": "GH API"}); err != nil {
+				t.Errorf("replaceKind() = %v", err)
+			}
+		}()
+		wg.Wait()
+
+		// Whichever update ran last, the glob rule must have survived.
+		if got := b.Bucket("us.gcr.io"); got != "GCR" {
+			t.Fatalf("Bucket(us.gcr.io) = %q, want GCR", got)
+		}
+	}
+}
+
+func TestParseHostBucketRules(t *testing.T) {
+	got, err := ParseHostBucketRules(strings.NewReader(`
+# Comments are ignored.
+exact:api.github.com=GH API
+suffix: googleapis.com = Google API
+glob:*.gcr.io=GCR
+regex:^(.+)\.a\.run\.app$=Cloud Run $1
+`))
+	if err != nil {
+		t.Fatalf("ParseHostBucketRules() = %v", err)
+	}
+	want := []HostBucketRule{
+		{Kind: RuleExact, Pattern: "api.github.com", Bucket: "GH API"},
+		{Kind: RuleSuffix, Pattern: "googleapis.com", Bucket: "Google API"},
+		{Kind: RuleGlob, Pattern: "*.gcr.io", Bucket: "GCR"},
+		{Kind: RuleRegexp, Pattern: `^(.+)\.a\.run\.app$`, Bucket: "Cloud Run $1"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ParseHostBucketRules() (-want +got): %s", diff)
+	}
+
+	for _, bad := range []string{"api.github.com=GH API", "exact:api.github.com"} {
+		if _, err := ParseHostBucketRules(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseHostBucketRules(%q) = nil, wanted error", bad)
+		}
+	}
+	for _, bad := range []HostBucketRule{
+		{Kind: "prefix", Pattern: "api", Bucket: "API"},
+		{Kind: RuleGlob, Pattern: "[", Bucket: "bad"},
+		{Kind: RuleRegexp, Pattern: "(", Bucket: "bad"},
+	} {
+		if _, err := NewHostBucketer([]HostBucketRule{bad}); err == nil {
+			t.Errorf("NewHostBucketer(%v) = nil, wanted error", bad)
+		}
+	}
+}
+
+func TestHostBucketerFromEnv(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "buckets")
+	if err := os.WriteFile(file, []byte("suffix:amazonaws.com=AWS\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HTTP_CLIENT_HOST_BUCKETS", "exact:cgr.dev=cgr.dev;glob:*.gcr.io=GCR")
+	t.Setenv("HTTP_CLIENT_HOST_BUCKETS_FILE", file)
+
+	b, err := HostBucketerFromEnv()
+	if err != nil {
+		t.Fatalf("HostBucketerFromEnv() = %v", err)
+	}
+	for _, c := range []struct{ host, bucket string }{
+		{"cgr.dev", "cgr.dev"},
+		{"us.gcr.io", "GCR"},
+		{"s3.us-east-1.amazonaws.com", "AWS"},
+		{"example.com", "other"},
+	} {
+		if got := b.Bucket(c.host); got != c.bucket {
+			t.Errorf("Bucket(%q) = %q, want %q", c.host, got, c.bucket)
+		}
+	}
+}
+
+func TestHostBucketerFromEnvEscapedSemicolon(t *testing.T) {
+	t.Setenv("HTTP_CLIENT_HOST_BUCKETS", `regex:^([a-z]+)\;v2\.example\.com$=v2 $1;exact:cgr.dev=cgr.dev`)
+	t.Setenv("HTTP_CLIENT_HOST_BUCKETS_FILE", "")
+
+	b, err := HostBucketerFromEnv()
+	if err != nil {
+		t.Fatalf("HostBucketerFromEnv() = %v", err)
+	}
+	want := []HostBucketRule{
+		{Kind: RuleRegexp, Pattern: `^([a-z]+);v2\.example\.com$`, Bucket: "v2 $1"},
+		{Kind: RuleExact, Pattern: "cgr.dev", Bucket: "cgr.dev"},
+	}
+	if diff := cmp.Diff(want, b.Rules()); diff != "" {
+		t.Errorf("Rules() (-want +got): %s", diff)
+	}
+	if got, want := b.Bucket("api;v2.example.com"), "v2 api"; got != want {
+		t.Errorf("Bucket() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// CeTimeHeader is the header of the time of binary mode CloudEvents.
+	CeTimeHeader = "ce-time"
+
+	// PubSubDeliveryAttemptHeader is the header with which Pub/Sub push
+	// subscriptions that write metadata, and have a dead letter policy,
+	// send the delivery attempt of the message, starting from 1.
+	// See https://cloud.google.com/pubsub/docs/payload-unwrapping
+	PubSubDeliveryAttemptHeader = "x-goog-pubsub-delivery-attempt"
+)
+
+// observeDelivery records how long CloudEvents took to be delivered, from
+// their ce-time, and the Pub/Sub delivery attempt of requests, as they
+// arrive. Requests without the headers aren't recorded.
+func (m *Metrics) observeDelivery(labels prometheus.Labels, next http.Handler) http.Handler {
+	latency := m.deliveryLatency.MustCurryWith(labels)
+	attempts := m.deliveryAttempts.MustCurryWith(labels)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ceType := prometheus.Labels{"ce_type": r.Header.Get(CeTypeHeader)}
+		if t, err := time.Parse(time.RFC3339Nano, r.Header.Get(CeTimeHeader)); err == nil {
+			// Clocks may be skewed.
+			observeWithExemplar(r.Context(), latency.With(ceType), max(time.Since(t).Seconds(), 0))
+		}
+		if n, err := strconv.Atoi(r.Header.Get(PubSubDeliveryAttemptHeader)); err == nil && n > 0 {
+			observeWithExemplar(r.Context(), attempts.With(ceType), float64(n))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestDeliveryMetrics(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	h := m.Handler("delivery", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set(CeTypeHeader, "dev.chainguard.test")
+	req.Header.Set(CeTimeHeader, time.Now().Add(-2*time.Minute).UTC().Format(time.RFC3339))
+	req.Header.Set(PubSubDeliveryAttemptHeader, "3")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	// Requests that aren't CloudEvents from Pub/Sub aren't recorded.
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	labels := prometheus.Labels{
+		"handler":            "delivery",
+		"ce_type":            "dev.chainguard.test",
+		"service_name":       env.KnativeServiceName,
+		"configuration_name": env.KnativeConfigurationName,
+		"revision_name":      env.KnativeRevisionName,
+	}
+	for name, c := range map[string]struct {
+		h        *prometheus.HistogramVec
+		min, max float64
+	}{
+		"cloudevent_delivery_latency_seconds": {m.deliveryLatency, 120, 130},
+		"pubsub_delivery_attempts":            {m.deliveryAttempts, 3, 3},
+	} {
+		if got := testutil.CollectAndCount(c.h); got != 1 {
+			t.Errorf("%s series = %d, want 1", name, got)
+		}
+		var pb dto.Metric
+		if err := c.h.With(labels).(prometheus.Metric).Write(&pb); err != nil {
+			t.Fatalf("Write() = %v", err)
+		}
+		if got := pb.GetHistogram().GetSampleSum(); got < c.min || got > c.max {
+			t.Errorf("%s sum = %v, want in [%v, %v]", name, got, c.min, c.max)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// These are the values of the "code" label of the client metrics for
+// requests that fail without a response. Dashboards and alerts depend on
+// them, so they must not change (including the odd "no-route-to_host").
+const (
+	errLabelContextCanceled    = "context-canceled"
+	errLabelDeadlineExceeded   = "deadline-exceeded"
+	errLabelDNSNotFound        = "dns-not-found"
+	errLabelDNSTimeout         = "dns-timeout"
+	errLabelDNSError           = "dns-error"
+	errLabelConnectionRefused  = "connection-refused"
+	errLabelConnectionReset    = "connection-reset"
+	errLabelNoRouteToHost      = "no-route-to_host"
+	errLabelNetworkUnreachable = "network-unreachable"
+	errLabelTLSTimeout         = "tls-handshake-timeout"
+	errLabelTLSError           = "tls-handshake-error"
+	errLabelX509UnknownCA      = "x509-unknown-authority"
+	errLabelX509Hostname       = "x509-hostname-mismatch"
+	errLabelX509Invalid        = "x509-invalid-certificate"
+	errLabelUnexpectedEOF      = "unexpected-eof"
+	errLabelEOF                = "eof"
+	errLabelIOTimeout          = "io-timeout"
+	errLabelDialError          = "dial-error"
+	errLabelNetworkError       = "network-error"
+	errLabelUnknown            = "unknown-error"
+)
+
+// mapErrorToLabel classifies the error returned by a RoundTripper into one of
+// the labels above. The checks are ordered from the most to the least
+// specific, since e.g. a DNS timeout is both a *net.DNSError and a timeout.
+func mapErrorToLabel(err error) string {
+	// Cancellation and deadlines are (usually) the caller's doing, so they
+	// take precedence over whatever the transport was doing at the time.
+	switch {
+	case errors.Is(err, context.Canceled):
+		return errLabelContextCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return errLabelDeadlineExceeded
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		switch {
+		case dnsErr.IsNotFound:
+			return errLabelDNSNotFound
+		case dnsErr.IsTimeout:
+			return errLabelDNSTimeout
+		default:
+			return errLabelDNSError
+		}
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errLabelConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET):
+		return errLabelConnectionReset
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return errLabelNoRouteToHost
+	case errors.Is(err, syscall.ENETUNREACH):
+		return errLabelNetworkUnreachable
+	}
+
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+	)
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return errLabelX509UnknownCA
+	case errors.As(err, &hostname):
+		return errLabelX509Hostname
+	case errors.As(err, &invalid):
+		return errLabelX509Invalid
+	}
+
+	// net/http doesn't export the type of its TLS handshake timeout.
+	if strings.Contains(err.Error(), "TLS handshake timeout") {
+		return errLabelTLSTimeout
+	}
+	var (
+		recordHeader *tls.RecordHeaderError
+		alert        tls.AlertError
+		verification *tls.CertificateVerificationError
+	)
+	if errors.As(err, &recordHeader) || errors.As(err, &alert) || errors.As(err, &verification) {
+		return errLabelTLSError
+	}
+
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errLabelUnexpectedEOF
+	case errors.Is(err, io.EOF):
+		return errLabelEOF
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errLabelIOTimeout
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		if opErr.Op == "dial" {
+			return errLabelDialError
+		}
+		return errLabelNetworkError
+	}
+	return errLabelUnknown
+}
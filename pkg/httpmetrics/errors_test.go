@@ -0,0 +1,101 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestMapErrorToLabel(t *testing.T) {
+	wrap := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://example.com", Err: err}
+	}
+	dial := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+	for _, c := range []struct {
+		err  error
+		want string
+	}{
+		{context.Canceled, "context-canceled"},
+		{wrap(context.DeadlineExceeded), "deadline-exceeded"},
+		{wrap(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "nope.example", IsNotFound: true}}), "dns-not-found"},
+		{wrap(&net.DNSError{Err: "i/o timeout", Name: "slow.example", IsTimeout: true}), "dns-timeout"},
+		{&net.DNSError{Err: "server misbehaving", Name: "bad.example"}, "dns-error"},
+		{wrap(dial(syscall.ECONNREFUSED)), "connection-refused"},
+		{wrap(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), "connection-reset"},
+		{wrap(dial(syscall.EHOSTUNREACH)), "no-route-to_host"},
+		{wrap(dial(syscall.ENETUNREACH)), "network-unreachable"},
+		{wrap(x509.UnknownAuthorityError{}), "x509-unknown-authority"},
+		{wrap(&tls.CertificateVerificationError{Err: x509.HostnameError{Host: "example.com", Certificate: &x509.Certificate{}}}), "x509-hostname-mismatch"},
+		{x509.CertificateInvalidError{Reason: x509.Expired}, "x509-invalid-certificate"},
+		{wrap(errors.New("net/http: TLS handshake timeout")), "tls-handshake-timeout"},
+		{wrap(&tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}), "tls-handshake-error"},
+		{wrap(tls.AlertError(42)), "tls-handshake-error"},
+		{fmt.Errorf("reading body: %w", io.ErrUnexpectedEOF), "unexpected-eof"},
+		{wrap(io.EOF), "eof"},
+		{wrap(&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}), "io-timeout"},
+		{wrap(&net.OpError{Op: "dial", Err: errors.New("something")}), "dial-error"},
+		{wrap(&net.OpError{Op: "write", Err: errors.New("something")}), "network-error"},
+		{wrap(errors.New("unsupported protocol scheme")), "unknown-error"},
+	} {
+		if got := mapErrorToLabel(c.err); got != c.want {
+			t.Errorf("mapErrorToLabel(%v) = %q, want %q", c.err, got, c.want)
+		}
+	}
+}
+
+func TestMapErrorToLabelRealErrors(t *testing.T) {
+	// A listener that's closed refuses connections.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := "http://" + l.Addr().String()
+	l.Close()
+
+	// The default transport doesn't trust the test server's certificate.
+	s := httptest.NewTLSServer(http.NotFoundHandler())
+	defer s.Close()
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, c := range []struct {
+		ctx  context.Context
+		url  string
+		want string
+	}{
+		{context.Background(), refused, "connection-refused"},
+		{context.Background(), s.URL, "x509-unknown-authority"},
+		{canceled, s.URL, "context-canceled"},
+	} {
+		req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, c.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+			t.Fatalf("RoundTrip(%s) succeeded, wanted error", c.url)
+		}
+		if got := mapErrorToLabel(err); got != c.want {
+			t.Errorf("mapErrorToLabel(%v) = %q, want %q", err, got, c.want)
+		}
+	}
+}
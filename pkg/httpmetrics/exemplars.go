@@ -0,0 +1,39 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// exemplarFromContext returns the exemplar labels linking an observation to
+// the sampled span in the context, if any. Spans that aren't sampled are
+// never exported, so there would be nothing to link to.
+func exemplarFromContext(ctx context.Context) prometheus.Labels {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() || !sc.IsSampled() {
+		return nil
+	}
+	return prometheus.Labels{
+		"trace_id": sc.TraceID().String(),
+		"span_id":  sc.SpanID().String(),
+	}
+}
+
+// observeWithExemplar records the value, with an exemplar when the context
+// carries a sampled span.
+func observeWithExemplar(ctx context.Context, obs prometheus.Observer, v float64) {
+	if labels := exemplarFromContext(ctx); labels != nil {
+		if eo, ok := obs.(prometheus.ExemplarObserver); ok {
+			eo.ObserveWithExemplar(v, labels)
+			return
+		}
+	}
+	obs.Observe(v)
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestObserveWithExemplar(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("105445aa7843bc8bf206b12000100000")
+	spanID, _ := trace.SpanIDFromHex("0000000000000800")
+
+	for _, c := range []struct {
+		name  string
+		flags trace.TraceFlags
+		want  map[string]string
+	}{{
+		name:  "sampled",
+		flags: trace.FlagsSampled,
+		want: map[string]string{
+			"trace_id": "105445aa7843bc8bf206b12000100000",
+			"span_id":  "0000000000000800",
+		},
+	}, {
+		name: "not sampled",
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID:    traceID,
+				SpanID:     spanID,
+				TraceFlags: c.flags,
+			}))
+			h := prometheus.NewHistogram(prometheus.HistogramOpts{
+				Name:    "test_duration_seconds",
+				Buckets: []float64{1},
+			})
+			observeWithExemplar(ctx, h, 0.5)
+
+			var m dto.Metric
+			if err := h.Write(&m); err != nil {
+				t.Fatalf("Write() = %v", err)
+			}
+			var got map[string]string
+			if ex := m.GetHistogram().GetBucket()[0].GetExemplar(); ex != nil {
+				got = map[string]string{}
+				for _, lp := range ex.GetLabel() {
+					got[lp.GetName()] = lp.GetValue()
+				}
+			}
+			if diff := cmp.Diff(c.want, got); diff != "" {
+				t.Errorf("exemplar (-want +got): %s", diff)
+			}
+			if got := m.GetHistogram().GetSampleCount(); got != 1 {
+				t.Errorf("sample count = %d, want 1", got)
+			}
+		})
+	}
+}
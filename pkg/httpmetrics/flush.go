@@ -0,0 +1,152 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+	otelprom "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// DefaultFlushTimeout bounds FlushMetrics, unless its context has an
+// earlier deadline.
+const DefaultFlushTimeout = 30 * time.Second
+
+// FlushOption configures FlushMetrics.
+type FlushOption func(*flushConfig)
+
+type flushConfig struct {
+	pushgateway string
+	timeout     time.Duration
+}
+
+// WithPushgateway pushes the metrics to the Pushgateway (or compatible
+// endpoint) at the URL, rather than over OTLP. It defaults to
+// METRICS_PUSHGATEWAY_URL.
+func WithPushgateway(url string) FlushOption {
+	return func(c *flushConfig) { c.pushgateway = url }
+}
+
+// WithFlushTimeout sets how long FlushMetrics retries before giving up,
+// which is DefaultFlushTimeout by default.
+func WithFlushTimeout(d time.Duration) FlushOption {
+	return func(c *flushConfig) { c.timeout = d }
+}
+
+// FlushMetrics pushes the metrics recorded by this package (along with
+// everything else registered with the default Prometheus registry), for
+// short-lived processes such as cron jobs that exit before they can be
+// scraped. By default, they are exported over OTLP/HTTP as configured by the
+// OTEL_EXPORTER_OTLP_* environment variables, which default to the OTLP
+// receiver of the otel-collector sidecar on localhost:4318. With the
+// sidecar, this must be called before quit.OtelSidecar. Without one, set
+// OTEL_EXPORTER_OTLP_ENDPOINT to another collector, or see WithPushgateway.
+//
+// Failed pushes are retried with backoff until the context is done or the
+// timeout (see WithFlushTimeout) is reached.
+//
+// Expected usage:
+//
+//	defer func() {
+//		if err := httpmetrics.FlushMetrics(ctx); err != nil {
+//			clog.FromContext(ctx).Errorf("FlushMetrics() = %v", err)
+//		}
+//	}()
+func FlushMetrics(ctx context.Context, opts ...FlushOption) error {
+	return defaultMetrics.FlushMetrics(ctx, opts...)
+}
+
+// FlushMetrics is FlushMetrics for the metrics in this Metrics' gatherer.
+func (m *Metrics) FlushMetrics(ctx context.Context, opts ...FlushOption) error {
+	if m.gatherer == nil {
+		return errors.New("httpmetrics: FlushMetrics requires a prometheus.Gatherer, see WithGatherer")
+	}
+	cfg := flushConfig{
+		pushgateway: os.Getenv("METRICS_PUSHGATEWAY_URL"),
+		timeout:     DefaultFlushTimeout,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout)
+	defer cancel()
+
+	if cfg.pushgateway != "" {
+		return retryFlush(ctx, m.pushgateway(cfg.pushgateway).PushContext)
+	}
+	return m.flushOTLP(ctx)
+}
+
+// pushgateway returns a pusher for the metrics, grouped by the job (or
+// service) and, in Cloud Run jobs, by the execution and task, so that the
+// tasks don't replace each other's metrics.
+func (m *Metrics) pushgateway(url string) *push.Pusher {
+	p := push.New(url, env.KnativeServiceName).Gatherer(m.gatherer)
+	if env.CloudRun.Job != "" {
+		p = p.Grouping("execution", env.CloudRun.Execution).Grouping("task_index", env.CloudRun.TaskIndex)
+	}
+	return p
+}
+
+func (m *Metrics) flushOTLP(ctx context.Context) error {
+	// We retry ourselves, within the same deadline as the Pushgateway.
+	exporter, err := otlpmetrichttp.New(ctx, otlpmetrichttp.WithRetry(otlpmetrichttp.RetryConfig{Enabled: false}))
+	if err != nil {
+		return fmt.Errorf("creating OTLP exporter: %w", err)
+	}
+	defer exporter.Shutdown(context.WithoutCancel(ctx)) //nolint:errcheck
+
+	res, err := newResource(ctx)
+	if err != nil {
+		return fmt.Errorf("detecting resource: %w", err)
+	}
+	reader := metric.NewManualReader(metric.WithProducer(otelprom.NewMetricProducer(
+		otelprom.WithGatherer(withoutSummaries(m.gatherer)),
+	)))
+	mp := metric.NewMeterProvider(metric.WithResource(res), metric.WithReader(reader))
+	defer mp.Shutdown(context.WithoutCancel(ctx)) //nolint:errcheck
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(ctx, &rm); err != nil {
+		return fmt.Errorf("collecting metrics: %w", err)
+	}
+	return retryFlush(ctx, func(ctx context.Context) error {
+		return exporter.Export(ctx, &rm)
+	})
+}
+
+// flushBackoff is the backoff between the attempts of FlushMetrics.
+var flushBackoff = retryConfig{initial: 100 * time.Millisecond, max: 5 * time.Second}
+
+// retryFlush calls push until it succeeds, or there is no time left to
+// try again, returning the last error.
+func retryFlush(ctx context.Context, push func(context.Context) error) error {
+	for retry := 0; ; retry++ {
+		err := push(ctx)
+		if err == nil {
+			return nil
+		}
+		delay := flushBackoff.backoff(retry)
+		if ctx.Err() != nil || !hasTimeFor(ctx, delay) {
+			return fmt.Errorf("flushing metrics: %w", err)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("flushing metrics: %w", err)
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// flakyReceiver fails the first requests, as many as fails, with a 503, and records the
+// bodies of the rest.
+type flakyReceiver struct {
+	fails int
+
+	mu     sync.Mutex
+	calls  int
+	bodies [][]byte
+	paths  []string
+}
+
+func (f *flakyReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.calls <= f.fails {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	f.bodies = append(f.bodies, body)
+	f.paths = append(f.paths, r.Method+" "+r.URL.Path)
+	// The OTLP exporter expects a protobuf response, which may be empty.
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+func newFlushMetrics(t *testing.T) *Metrics {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	m, err := NewMetrics(reg, WithGatherer(reg))
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	m.mReqCount.With(prometheus.Labels{
+		"code":               "200",
+		"method":             http.MethodGet,
+		"host":               "flush-test",
+		"service_name":       env.KnativeServiceName,
+		"configuration_name": env.KnativeConfigurationName,
+		"revision_name":      env.KnativeRevisionName,
+		"ce_type":            "",
+		"operation":          "",
+	}).Inc()
+	return m
+}
+
+func TestFlushMetrics(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		setup    func(t *testing.T, url string) []FlushOption
+		wantPath string
+	}{{
+		name: "pushgateway",
+		setup: func(_ *testing.T, url string) []FlushOption {
+			return []FlushOption{WithPushgateway(url)}
+		},
+		wantPath: "PUT /metrics/job/" + env.KnativeServiceName,
+	}, {
+		name: "otlp",
+		setup: func(t *testing.T, url string) []FlushOption {
+			t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", url)
+			return nil
+		},
+		wantPath: "POST /v1/metrics",
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv("METRICS_PUSHGATEWAY_URL", "")
+			recv := &flakyReceiver{fails: 2}
+			srv := httptest.NewServer(recv)
+			defer srv.Close()
+			opts := c.setup(t, srv.URL)
+			if err := newFlushMetrics(t).FlushMetrics(context.Background(), opts...); err != nil {
+				t.Fatalf("FlushMetrics() = %v", err)
+			}
+
+			recv.mu.Lock()
+			defer recv.mu.Unlock()
+			if recv.calls != 3 {
+				t.Errorf("calls = %d, want 3", recv.calls)
+			}
+			if len(recv.paths) != 1 || recv.paths[0] != c.wantPath {
+				t.Errorf("requests = %v, want [%s]", recv.paths, c.wantPath)
+			}
+			if len(recv.bodies) != 1 || !bytes.Contains(recv.bodies[0], []byte("flush-test")) {
+				t.Error("the pushed metrics don't include the series of http_client_request_count")
+			}
+		})
+	}
+}
+
+func TestFlushMetricsDeadline(t *testing.T) {
+	srv := httptest.NewServer(&flakyReceiver{fails: 1 << 30})
+	defer srv.Close()
+
+	start := time.Now()
+	err := newFlushMetrics(t).FlushMetrics(context.Background(), WithPushgateway(srv.URL), WithFlushTimeout(500*time.Millisecond))
+	if err == nil {
+		t.Fatal("FlushMetrics() = nil, want an error")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("FlushMetrics() took %v, want it to give up after its timeout", d)
+	}
+}
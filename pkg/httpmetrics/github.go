@@ -0,0 +1,353 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// githubDotCom is the host of the GitHub API on github.com.
+const githubDotCom = "api.github.com"
+
+type githubConfig struct {
+	// enterpriseHosts are the GitHub Enterprise Server hosts, whose API is
+	// served under /api/v3 and /api/graphql.
+	enterpriseHosts []string
+	hashTokens      bool
+	// byIdentity records the rate limits of each identity, see
+	// WithGitHubRateLimitsByIdentity.
+	byIdentity bool
+}
+
+// WithGitHubEnterpriseHosts records the rate limits of GitHub Enterprise
+// Server hosts, in addition to those of api.github.com.
+func WithGitHubEnterpriseHosts(hosts ...string) TransportOption {
+	return func(c *transportConfig) { c.github.enterpriseHosts = append(c.github.enterpriseHosts, hosts...) }
+}
+
+// WithGitHubTokenIdentity identifies the GitHub rate limits of requests
+// without WithGitHubIdentity by a hash of their token. Since installation
+// tokens expire hourly, this is only suitable for long-lived tokens, e.g.
+// PATs.
+func WithGitHubTokenIdentity() TransportOption {
+	return func(c *transportConfig) { c.github.hashTokens = true }
+}
+
+// WithGitHubRateLimitsByIdentity also records the rate limits of each
+// identity (see WithGitHubIdentity and WithGitHubTokenIdentity) in the
+// github_identity_* metrics, as the github_rate_limit* gauges hold the last
+// values seen for each host and resource, whichever identity they came from.
+// Identities beyond the first 100 are labeled "other".
+func WithGitHubRateLimitsByIdentity() TransportOption {
+	return func(c *transportConfig) { c.github.byIdentity = true }
+}
+
+type githubIdentityKey struct{}
+
+// WithGitHubIdentity sets the identity of the GitHub rate limits of the
+// requests made with the context, e.g. to the ID of the GitHub App
+// installation, so that the budget of each is throttled (see
+// WithGitHubThrottling) and recorded (see WithGitHubRateLimitsByIdentity)
+// separately. The identity must come from a bounded set.
+//
+// The GraphQL points counted by github_graphql_points_used_total are only
+// those of requests with an identity, from this or WithGitHubTokenIdentity,
+// as X-RateLimit-Used can't be followed across the budgets of several
+// installations.
+func WithGitHubIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, githubIdentityKey{}, identity)
+}
+
+// isGitHubAPI reports whether the request is to the GitHub API.
+func (c githubConfig) isGitHubAPI(r *http.Request) bool {
+	if r.URL.Host == githubDotCom {
+		return true
+	}
+	return slices.Contains(c.enterpriseHosts, r.URL.Host) && strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+// identity returns the "identity" label of the request.
+func (c githubConfig) identity(r *http.Request) string {
+	if id, ok := r.Context().Value(githubIdentityKey{}).(string); ok {
+		return id
+	}
+	if !c.hashTokens {
+		return ""
+	}
+	_, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// githubAPIPath returns the path of the request relative to the API root,
+// which is /api/v3 (or /api for GraphQL) on GitHub Enterprise Server.
+func githubAPIPath(r *http.Request) string {
+	if r.URL.Host == githubDotCom {
+		return r.URL.Path
+	}
+	if p, ok := strings.CutPrefix(r.URL.Path, "/api/v3"); ok {
+		return p
+	}
+	return strings.TrimPrefix(r.URL.Path, "/api")
+}
+
+// githubKey identifies a rate limit budget.
+type githubKey struct {
+	host, identity, resource string
+}
+
+func (k githubKey) labels() prometheus.Labels {
+	return prometheus.Labels{"host": k.host, "identity": k.identity, "resource": k.resource}
+}
+
+// maxGitHubIdentities bounds the distinct values of the "identity" label of
+// the github_identity_* metrics.
+const maxGitHubIdentities = 100
+
+// otherIdentity is the identity of requests beyond maxGitHubIdentities.
+const otherIdentity = "other"
+
+// githubIdentities bounds the identities of the github_identity_* metrics.
+type githubIdentities struct {
+	mu     sync.Mutex
+	issued map[string]struct{}
+}
+
+// label returns the identity, or "other" once the cap is reached.
+func (g *githubIdentities) label(identity string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.issued[identity]; !ok {
+		if len(g.issued) >= maxGitHubIdentities {
+			return otherIdentity
+		}
+		g.issued[identity] = struct{}{}
+	}
+	return identity
+}
+
+func (m *Metrics) newGitHubCollectors() {
+	labels := []string{"host", "resource"}
+	m.mGitHubRateLimitRemaining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_rate_limit_remaining",
+			Help: "The number of requests remaining in the current rate limit window",
+		},
+		labels,
+	)
+	m.mGitHubRateLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_rate_limit",
+			Help: "The number of requests allowed during the rate limit window",
+		},
+		labels,
+	)
+	m.mGitHubRateLimitReset = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_rate_limit_reset",
+			Help: "The timestamp at which the current rate limit window resets",
+		},
+		labels,
+	)
+	m.mGitHubRateLimitUsed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_rate_limit_used",
+			Help: "The fraction of the rate limit window used",
+		},
+		labels,
+	)
+	m.mGitHubRateLimitTimeToReset = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_rate_limit_time_to_reset",
+			Help: "The number of minutes until the current rate limit window resets",
+		},
+		labels,
+	)
+	m.mGitHubGraphQLPoints = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_graphql_points_used_total",
+			Help: "The GraphQL rate limit points used by requests with an identity, as reported by X-RateLimit-Used",
+		},
+		[]string{"host"},
+	)
+
+	identityLabels := []string{"host", "identity", "resource"}
+	m.mGitHubIdentityRemaining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_identity_rate_limit_remaining",
+			Help: "The number of requests remaining in the current rate limit window of the identity",
+		},
+		identityLabels,
+	)
+	m.mGitHubIdentityLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_identity_rate_limit",
+			Help: "The number of requests the identity is allowed during the rate limit window",
+		},
+		identityLabels,
+	)
+	m.mGitHubIdentityUsed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_identity_rate_limit_used",
+			Help: "The fraction of the rate limit window of the identity used",
+		},
+		identityLabels,
+	)
+	m.mGitHubIdentityReset = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_identity_rate_limit_reset",
+			Help: "The timestamp at which the current rate limit window of the identity resets",
+		},
+		identityLabels,
+	)
+	m.mGitHubIdentityGraphQLPoints = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_identity_graphql_points_used_total",
+			Help: "The GraphQL rate limit points used by the identity, as reported by X-RateLimit-Used",
+		},
+		[]string{"host", "identity"},
+	)
+}
+
+// maxGraphQLWindows bounds the memory used to follow GraphQL usage.
+const maxGraphQLWindows = 1000
+
+// graphqlUsage follows X-RateLimit-Used of the GraphQL resource of each
+// budget, to count the points used by the queries. Only the requests with an
+// identity are followed: the budgets of the installations that share the
+// empty identity would interleave, and their points would be lost.
+type graphqlUsage struct {
+	mu    sync.Mutex
+	state map[githubKey]graphqlWindow
+}
+
+type graphqlWindow struct {
+	reset int64
+	used  int
+}
+
+// add returns the points used since the last response for the key. Within a
+// window, X-RateLimit-Used only grows, so stale responses add nothing.
+func (g *graphqlUsage) add(k githubKey, reset int64, used int, now time.Time) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	prev, ok := g.state[k]
+	if !ok && len(g.state) >= maxGraphQLWindows {
+		g.prune(now)
+	}
+	switch {
+	case !ok || reset > prev.reset:
+		g.state[k] = graphqlWindow{reset: reset, used: used}
+		if !ok {
+			// We don't know what was used before we started counting.
+			return 0
+		}
+		return used
+	case reset == prev.reset && used > prev.used:
+		g.state[k] = graphqlWindow{reset: reset, used: used}
+		return used - prev.used
+	default:
+		return 0
+	}
+}
+
+// prune forgets the windows that have reset, or all of them if none have.
+func (g *graphqlUsage) prune(now time.Time) {
+	for k, w := range g.state {
+		if w.reset <= now.Unix() {
+			delete(g.state, k)
+		}
+	}
+	if len(g.state) >= maxGraphQLWindows {
+		clear(g.state)
+	}
+}
+
+// instrumentGitHubRateLimits is a promhttp.RoundTripperFunc that records GitHub rate limit metrics.
+// See https://docs.github.com/en/rest/using-the-rest-api/rate-limits-for-the-rest-api?apiVersion=2022-11-28
+// and https://docs.github.com/en/graphql/overview/rate-limits-and-node-limits-for-the-graphql-api
+func (m *Metrics) instrumentGitHubRateLimits(c githubConfig, next http.RoundTripper) promhttp.RoundTripperFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		resp, err := next.RoundTrip(r)
+		if err != nil {
+			return resp, err
+		}
+		if c.isGitHubAPI(r) {
+			resource := resp.Header.Get("X-RateLimit-Resource")
+			if resource == "" {
+				resource = "unknown"
+			}
+			key := githubKey{host: r.URL.Host, identity: c.identity(r), resource: resource}
+			labels := prometheus.Labels{"host": key.host, "resource": key.resource}
+
+			val := func(key string) float64 {
+				val := resp.Header.Get(key)
+				if val == "" {
+					return 0
+				}
+				i, err := strconv.Atoi(val)
+				if err != nil {
+					return 0
+				}
+				return float64(i)
+			}
+			remaining := val("X-RateLimit-Remaining")
+			m.mGitHubRateLimitRemaining.With(labels).Set(remaining)
+
+			limit := val("X-RateLimit-Limit")
+			m.mGitHubRateLimit.With(labels).Set(limit)
+
+			reset := val("X-RateLimit-Reset")
+			m.mGitHubRateLimitReset.With(labels).Set(reset)
+
+			if limit > 0 {
+				used := (limit - remaining) / limit
+				m.mGitHubRateLimitUsed.With(labels).Set(used)
+			}
+
+			if reset > 0 {
+				timeToReset := time.Until(time.Unix(int64(reset), 0)).Minutes()
+				m.mGitHubRateLimitTimeToReset.With(labels).Set(timeToReset)
+			}
+
+			var points int
+			if resource == "graphql" && key.identity != "" && reset > 0 && resp.Header.Get("X-RateLimit-Used") != "" {
+				if points = m.graphqlUsage.add(key, int64(reset), int(val("X-RateLimit-Used")), time.Now()); points > 0 {
+					m.mGitHubGraphQLPoints.With(prometheus.Labels{"host": key.host}).Add(float64(points))
+				}
+			}
+
+			if c.byIdentity {
+				key.identity = m.githubIdentities.label(key.identity)
+				labels := key.labels()
+				m.mGitHubIdentityRemaining.With(labels).Set(remaining)
+				m.mGitHubIdentityLimit.With(labels).Set(limit)
+				m.mGitHubIdentityReset.With(labels).Set(reset)
+				if limit > 0 {
+					m.mGitHubIdentityUsed.With(labels).Set((limit - remaining) / limit)
+				}
+				if points > 0 {
+					m.mGitHubIdentityGraphQLPoints.With(prometheus.Labels{"host": key.host, "identity": key.identity}).Add(float64(points))
+				}
+			}
+		}
+		return resp, err
+	}
+}
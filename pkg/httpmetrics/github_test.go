@@ -0,0 +1,207 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGitHubConfig(t *testing.T) {
+	c := githubConfig{enterpriseHosts: []string{"ghes.example.com"}}
+	for _, tc := range []struct {
+		url          string
+		wantAPI      bool
+		wantResource string
+	}{
+		{"https://api.github.com/repos/a/b", true, "core"},
+		{"https://api.github.com/graphql", true, "graphql"},
+		{"https://ghes.example.com/api/v3/search/code?q=x", true, "code_search"},
+		{"https://ghes.example.com/api/graphql", true, "graphql"},
+		{"https://ghes.example.com/a/b", false, "core"},
+		{"https://github.com/a/b", false, "core"},
+	} {
+		r, _ := http.NewRequest(http.MethodGet, tc.url, nil)
+		if got := c.isGitHubAPI(r); got != tc.wantAPI {
+			t.Errorf("isGitHubAPI(%s) = %t, want %t", tc.url, got, tc.wantAPI)
+		}
+		if got := githubResource(r); got != tc.wantResource {
+			t.Errorf("githubResource(%s) = %s, want %s", tc.url, got, tc.wantResource)
+		}
+	}
+}
+
+func TestGitHubIdentity(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "https://api.github.com/", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+
+	if got := (githubConfig{}).identity(r); got != "" {
+		t.Errorf("identity() = %q, want none", got)
+	}
+	hashed := (githubConfig{hashTokens: true}).identity(r)
+	if !strings.HasPrefix(hashed, "sha256:") || strings.Contains(hashed, "secret") {
+		t.Errorf("identity() = %q, want a hash", hashed)
+	}
+	r = r.WithContext(WithGitHubIdentity(r.Context(), "installation-1234"))
+	if got := (githubConfig{hashTokens: true}).identity(r); got != "installation-1234" {
+		t.Errorf("identity() = %q, want installation-1234", got)
+	}
+}
+
+func TestGitHubGraphQLPoints(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	reset := time.Now().Add(time.Hour).Unix()
+	var calls int
+	headers := map[string]string{
+		"X-RateLimit-Resource":  "graphql",
+		"X-RateLimit-Limit":     "5000",
+		"X-RateLimit-Remaining": "4990",
+		"X-RateLimit-Used":      "10",
+		"X-RateLimit-Reset":     fmt.Sprint(reset),
+	}
+	client := &http.Client{Transport: m.WrapTransport(fakeGitHub(&calls, http.StatusOK, headers),
+		WithGitHubEnterpriseHosts("ghes.example.com"), WithGitHubRateLimitsByIdentity())}
+
+	ctx := WithGitHubIdentity(context.Background(), "app")
+	for _, used := range []string{"10", "15", "12", "21"} {
+		headers["X-RateLimit-Used"] = used
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "https://ghes.example.com/api/graphql", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Do() = %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	// The first response sets the baseline, and the stale third is ignored.
+	if got := testutil.ToFloat64(m.mGitHubGraphQLPoints.With(prometheus.Labels{"host": "ghes.example.com"})); got != 11 {
+		t.Errorf("github_graphql_points_used_total = %v, want 11", got)
+	}
+	if got := testutil.ToFloat64(m.mGitHubIdentityGraphQLPoints.With(prometheus.Labels{"host": "ghes.example.com", "identity": "app"})); got != 11 {
+		t.Errorf("github_identity_graphql_points_used_total = %v, want 11", got)
+	}
+	if got := testutil.ToFloat64(m.mGitHubRateLimitRemaining.With(prometheus.Labels{"host": "ghes.example.com", "resource": "graphql"})); got != 4990 {
+		t.Errorf("github_rate_limit_remaining = %v, want 4990", got)
+	}
+	if got := testutil.ToFloat64(m.mGitHubIdentityRemaining.With(prometheus.Labels{"host": "ghes.example.com", "identity": "app", "resource": "graphql"})); got != 4990 {
+		t.Errorf("github_identity_rate_limit_remaining = %v, want 4990", got)
+	}
+
+	// A new window counts from zero.
+	headers["X-RateLimit-Reset"] = fmt.Sprint(reset + 3600)
+	headers["X-RateLimit-Used"] = "3"
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "https://ghes.example.com/api/graphql", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do() = %v", err)
+	}
+	resp.Body.Close()
+	if got := testutil.ToFloat64(m.mGitHubGraphQLPoints.With(prometheus.Labels{"host": "ghes.example.com"})); got != 14 {
+		t.Errorf("github_graphql_points_used_total = %v, want 14", got)
+	}
+}
+
+func TestGitHubGraphQLPointsWithoutIdentity(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	reset := time.Now().Add(time.Hour).Unix()
+	var calls int
+	headers := map[string]string{
+		"X-RateLimit-Resource": "graphql",
+		"X-RateLimit-Reset":    fmt.Sprint(reset),
+	}
+	client := &http.Client{Transport: m.WrapTransport(fakeGitHub(&calls, http.StatusOK, headers))}
+
+	// Two installations without an identity interleave under the same key.
+	for _, used := range []string{"10", "500", "15", "510"} {
+		headers["X-RateLimit-Used"] = used
+		resp, err := client.Post("https://api.github.com/graphql", "application/json", nil)
+		if err != nil {
+			t.Fatalf("Post() = %v", err)
+		}
+		resp.Body.Close()
+	}
+	if got := testutil.CollectAndCount(m.mGitHubGraphQLPoints); got != 0 {
+		t.Errorf("github_graphql_points_used_total series = %d, want 0", got)
+	}
+}
+
+func TestGitHubRateLimitsWithoutIdentity(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	var calls int
+	client := &http.Client{Transport: m.WrapTransport(fakeGitHub(&calls, http.StatusOK, map[string]string{
+		"X-RateLimit-Resource":  "core",
+		"X-RateLimit-Limit":     "5000",
+		"X-RateLimit-Remaining": "4000",
+		"X-RateLimit-Reset":     fmt.Sprint(time.Now().Add(time.Hour).Unix()),
+	}), WithGitHubTokenIdentity())}
+
+	for _, token := range []string{"one", "two"} {
+		req, _ := http.NewRequest(http.MethodGet, "https://api.github.com/repos/a/b", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Do() = %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	// Without WithGitHubRateLimitsByIdentity, the gauges keep one series per
+	// host and resource, and nothing is recorded by identity.
+	if got := testutil.ToFloat64(m.mGitHubRateLimitUsed.With(prometheus.Labels{"host": "api.github.com", "resource": "core"})); got != 0.2 {
+		t.Errorf("github_rate_limit_used = %v, want 0.2", got)
+	}
+	if got := testutil.CollectAndCount(m.mGitHubRateLimitUsed); got != 1 {
+		t.Errorf("github_rate_limit_used series = %d, want 1", got)
+	}
+	if got := testutil.CollectAndCount(m.mGitHubIdentityUsed); got != 0 {
+		t.Errorf("github_identity_rate_limit_used series = %d, want 0", got)
+	}
+}
+
+func TestGitHubIdentitiesBounded(t *testing.T) {
+	g := githubIdentities{issued: map[string]struct{}{}}
+	for i := 0; i < maxGitHubIdentities; i++ {
+		if id := fmt.Sprint("installation-", i); g.label(id) != id {
+			t.Fatalf("label(%s) = %s, want %s", id, g.label(id), id)
+		}
+	}
+	if got := g.label("installation-new"); got != otherIdentity {
+		t.Errorf("label() = %s, want %s", got, otherIdentity)
+	}
+	if got := g.label("installation-0"); got != "installation-0" {
+		t.Errorf("label() = %s, want installation-0", got)
+	}
+}
+
+func TestGraphQLUsageBounded(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	g := graphqlUsage{state: map[githubKey]graphqlWindow{}}
+	for i := 0; i < maxGraphQLWindows; i++ {
+		g.add(githubKey{host: githubDotCom, identity: fmt.Sprint(i), resource: "graphql"}, now.Unix(), 1, now)
+	}
+	// Once full, the windows that have reset are forgotten.
+	later := now.Add(time.Hour)
+	g.add(githubKey{host: githubDotCom, identity: "new", resource: "graphql"}, later.Unix(), 1, later)
+	if got := len(g.state); got != 1 {
+		t.Errorf("windows = %d, want 1", got)
+	}
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The names of the gRPC metrics follow go-grpc-prometheus, which the
+// dashboard's grpc section expects.
+func (m *Metrics) newGRPCCollectors() {
+	m.grpcServerHandled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_server_handled_total",
+			Help: "The total number of RPCs completed on the server, regardless of success or failure.",
+		},
+		[]string{"grpc_type", "grpc_service", "grpc_method", "grpc_code", "service_name", "configuration_name", "revision_name"},
+	)
+	m.grpcServerInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "grpc_server_in_flight",
+			Help: "The number of RPCs currently being handled by the server.",
+		},
+		[]string{"grpc_type", "grpc_service", "grpc_method", "service_name", "configuration_name", "revision_name"},
+	)
+	m.grpcClientHandled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_client_handled_total",
+			Help: "The total number of RPCs completed by the client, regardless of success or failure.",
+		},
+		[]string{"grpc_type", "grpc_service", "grpc_method", "grpc_code", "host", "service_name", "configuration_name", "revision_name"},
+	)
+	m.grpcClientInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "grpc_client_in_flight",
+			Help: "The number of RPCs currently inflight from the client.",
+		},
+		[]string{"grpc_type", "grpc_service", "grpc_method", "host", "service_name", "configuration_name", "revision_name"},
+	)
+}
+
+// The values of the "grpc_type" label.
+const (
+	grpcUnary        = "unary"
+	grpcClientStream = "client_stream"
+	grpcServerStream = "server_stream"
+	grpcBidiStream   = "bidi_stream"
+)
+
+func streamType(desc *grpc.StreamDesc) string {
+	switch {
+	case desc.ClientStreams && desc.ServerStreams:
+		return grpcBidiStream
+	case desc.ClientStreams:
+		return grpcClientStream
+	default:
+		return grpcServerStream
+	}
+}
+
+// splitMethod splits "/package.Service/Method" into its service and method.
+func splitMethod(fullMethod string) (string, string) {
+	service, method, ok := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if !ok {
+		return "unknown", "unknown"
+	}
+	return service, method
+}
+
+// grpcTargetHost returns the host of a gRPC dial target, such as
+// "dns:///foo.googleapis.com:443" or "foo:8080", for host bucketing.
+func grpcTargetHost(target string) string {
+	if _, rest, ok := strings.Cut(target, "://"); ok {
+		// The authority is usually empty, and the endpoint is the path.
+		if i := strings.LastIndex(rest, "/"); i >= 0 {
+			rest = rest[i+1:]
+		}
+		target = rest
+	}
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		return host
+	}
+	return target
+}
+
+// ServerOptions instruments a gRPC server: the otelgrpc stats handler
+// traces its RPCs, continuing the traces of their callers, and the
+// interceptors record their metrics.
+//
+// Expected usage:
+//
+//	srv := grpc.NewServer(httpmetrics.ServerOptions()...)
+func ServerOptions() []grpc.ServerOption {
+	return defaultMetrics.ServerOptions()
+}
+
+// ServerOptions instruments a gRPC server, see ServerOptions.
+func (m *Metrics) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(m.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(m.StreamServerInterceptor()),
+	}
+}
+
+// DialOptions instruments a gRPC client: the otelgrpc stats handler traces
+// its RPCs, propagating the trace to the server, and the interceptors record
+// their metrics, with the "host" label taken from the target of the
+// connection, bucketed by DefaultHostBucketer or WithHostBucketer.
+//
+// Expected usage:
+//
+//	conn, err := grpc.Dial(target, append(httpmetrics.DialOptions(), ...)...)
+func DialOptions(opts ...TransportOption) []grpc.DialOption {
+	return defaultMetrics.DialOptions(opts...)
+}
+
+// DialOptions instruments a gRPC client, see DialOptions.
+func (m *Metrics) DialOptions(opts ...TransportOption) []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+		grpc.WithChainUnaryInterceptor(m.UnaryClientInterceptor(opts...)),
+		grpc.WithChainStreamInterceptor(m.StreamClientInterceptor(opts...)),
+	}
+}
+
+// grpcCode returns the status code of the error returned by an RPC.
+func grpcCode(err error) codes.Code {
+	if errors.Is(err, io.EOF) {
+		return codes.OK
+	}
+	return status.Code(err)
+}
+
+// serverRPC records the metrics of one RPC handled by the server.
+func (m *Metrics) serverRPC(ctx context.Context, typ, fullMethod string) func(error) {
+	m.mustInitHistograms()
+	service, method := splitMethod(fullMethod)
+	labels := prometheus.Labels{
+		"grpc_type":          typ,
+		"grpc_service":       service,
+		"grpc_method":        method,
+		"service_name":       env.KnativeServiceName,
+		"configuration_name": env.KnativeConfigurationName,
+		"revision_name":      env.KnativeRevisionName,
+	}
+	inFlight := m.grpcServerInFlight.With(labels)
+	inFlight.Inc()
+	start := time.Now()
+	return func(err error) {
+		inFlight.Dec()
+		observeWithExemplar(ctx, m.grpcServerHandling.With(labels), time.Since(start).Seconds())
+		labels["grpc_code"] = grpcCode(err).String()
+		m.grpcServerHandled.With(labels).Inc()
+	}
+}
+
+// UnaryServerInterceptor records the metrics of the unary RPCs of a gRPC
+// server. See ServerOptions, which also traces them.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return defaultMetrics.UnaryServerInterceptor()
+}
+
+// UnaryServerInterceptor instruments the unary RPCs of a gRPC server.
+func (m *Metrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		done := m.serverRPC(ctx, grpcUnary, info.FullMethod)
+		resp, err := handler(ctx, req)
+		done(err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor records the metrics of the streaming RPCs of a
+// gRPC server. See ServerOptions, which also traces them.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return defaultMetrics.StreamServerInterceptor()
+}
+
+// StreamServerInterceptor instruments the streaming RPCs of a gRPC server.
+func (m *Metrics) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		typ := streamType(&grpc.StreamDesc{ClientStreams: info.IsClientStream, ServerStreams: info.IsServerStream})
+		done := m.serverRPC(ss.Context(), typ, info.FullMethod)
+		err := handler(srv, ss)
+		done(err)
+		return err
+	}
+}
+
+// clientRPC records the metrics of one RPC made by the client.
+func (m *Metrics) clientRPC(ctx context.Context, b *HostBucketer, typ, target, fullMethod string) func(error) {
+	m.mustInitHistograms()
+	service, method := splitMethod(fullMethod)
+	labels := prometheus.Labels{
+		"grpc_type":          typ,
+		"grpc_service":       service,
+		"grpc_method":        method,
+		"host":               b.Bucket(grpcTargetHost(target)),
+		"service_name":       env.KnativeServiceName,
+		"configuration_name": env.KnativeConfigurationName,
+		"revision_name":      env.KnativeRevisionName,
+	}
+	inFlight := m.grpcClientInFlight.With(labels)
+	inFlight.Inc()
+	start := time.Now()
+	return func(err error) {
+		inFlight.Dec()
+		observeWithExemplar(ctx, m.grpcClientHandling.With(labels), time.Since(start).Seconds())
+		labels["grpc_code"] = grpcCode(err).String()
+		m.grpcClientHandled.With(labels).Inc()
+	}
+}
+
+// UnaryClientInterceptor records the metrics of the unary RPCs of a gRPC
+// client. It takes the "host" label from the target of the connection,
+// bucketed by DefaultHostBucketer or WithHostBucketer. See DialOptions, which
+// also traces them.
+func UnaryClientInterceptor(opts ...TransportOption) grpc.UnaryClientInterceptor {
+	return defaultMetrics.UnaryClientInterceptor(opts...)
+}
+
+// UnaryClientInterceptor instruments the unary RPCs of a gRPC client.
+func (m *Metrics) UnaryClientInterceptor(opts ...TransportOption) grpc.UnaryClientInterceptor {
+	cfg := newTransportConfig(opts)
+	return func(ctx context.Context, fullMethod string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		done := m.clientRPC(ctx, cfg.bucketer, grpcUnary, cc.Target(), fullMethod)
+		err := invoker(ctx, fullMethod, req, reply, cc, callOpts...)
+		done(err)
+		return err
+	}
+}
+
+// StreamClientInterceptor records the metrics of the streaming RPCs of a
+// gRPC client, once gRPC finishes them: when they are drained, fail, or
+// their context is done. See DialOptions, which also traces them.
+func StreamClientInterceptor(opts ...TransportOption) grpc.StreamClientInterceptor {
+	return defaultMetrics.StreamClientInterceptor(opts...)
+}
+
+// StreamClientInterceptor records the metrics of the streaming RPCs of a
+// gRPC client.
+func (m *Metrics) StreamClientInterceptor(opts ...TransportOption) grpc.StreamClientInterceptor {
+	cfg := newTransportConfig(opts)
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, fullMethod string, streamer grpc.Streamer, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+		done := m.clientRPC(ctx, cfg.bucketer, streamType(desc), cc.Target(), fullMethod)
+		var once sync.Once
+		finish := func(err error) { once.Do(func() { done(err) }) }
+		cs, err := streamer(ctx, desc, cc, fullMethod, append(callOpts, grpc.OnFinish(finish))...)
+		if err != nil {
+			finish(err)
+			return nil, err
+		}
+		return cs, nil
+	}
+}
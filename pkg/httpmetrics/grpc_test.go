@@ -0,0 +1,175 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCTargetHost(t *testing.T) {
+	for target, want := range map[string]string{
+		"dns:///foo.googleapis.com:443": "foo.googleapis.com",
+		"passthrough:///bufnet":         "bufnet",
+		"unix:///tmp/sock":              "sock",
+		"localhost:8080":                "localhost",
+		"example.com":                   "example.com",
+	} {
+		if got := grpcTargetHost(target); got != want {
+			t.Errorf("grpcTargetHost(%q) = %q, want %q", target, got, want)
+		}
+	}
+}
+
+func TestGRPCInterceptors(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := trace.NewTracerProvider(trace.WithSpanProcessor(sr))
+	defer tp.Shutdown(context.Background())
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	}()
+
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	b, err := NewHostBucketer([]HostBucketRule{{Kind: RuleExact, Pattern: "bufnet", Bucket: "buf"}})
+	if err != nil {
+		t.Fatalf("NewHostBucketer() = %v", err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(m.ServerOptions()...)
+	hs := health.NewServer()
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(lis) //nolint:errcheck
+	defer srv.Stop()
+
+	conn, err := grpc.Dial("passthrough:///bufnet", append(m.DialOptions(WithHostBucketer(b)),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)...)
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	ctx, span := tp.Tracer("test").Start(context.Background(), "parent")
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatalf("Check() = %v", err)
+	}
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "missing"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("Check(missing) = %v, want NotFound", err)
+	}
+	span.End()
+
+	// Watch sends the current status, and then blocks until cancelled. The
+	// stream is finished by its cancellation, without being drained.
+	wctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.Watch(wctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch() = %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	watchInFlight := prometheus.Labels{
+		"grpc_type":          grpcServerStream,
+		"grpc_service":       "grpc.health.v1.Health",
+		"grpc_method":        "Watch",
+		"host":               "buf",
+		"service_name":       env.KnativeServiceName,
+		"configuration_name": env.KnativeConfigurationName,
+		"revision_name":      env.KnativeRevisionName,
+	}
+	if got := testutil.ToFloat64(m.grpcClientInFlight.With(watchInFlight)); got != 1 {
+		t.Errorf("grpc_client_in_flight{Watch} = %v, want 1", got)
+	}
+	cancel()
+	for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(m.grpcClientInFlight.With(watchInFlight)) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("grpc_client_in_flight{Watch} never dropped to 0")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	serverLabels := func(typ, method, code string) prometheus.Labels {
+		return prometheus.Labels{
+			"grpc_type":          typ,
+			"grpc_service":       "grpc.health.v1.Health",
+			"grpc_method":        method,
+			"grpc_code":          code,
+			"service_name":       env.KnativeServiceName,
+			"configuration_name": env.KnativeConfigurationName,
+			"revision_name":      env.KnativeRevisionName,
+		}
+	}
+	clientLabels := func(typ, method, code string) prometheus.Labels {
+		l := serverLabels(typ, method, code)
+		l["host"] = "buf"
+		return l
+	}
+	for _, c := range []struct {
+		vec    *prometheus.CounterVec
+		labels prometheus.Labels
+	}{
+		{m.grpcClientHandled, clientLabels(grpcUnary, "Check", "OK")},
+		{m.grpcClientHandled, clientLabels(grpcUnary, "Check", "NotFound")},
+		{m.grpcClientHandled, clientLabels(grpcServerStream, "Watch", "Canceled")},
+		{m.grpcServerHandled, serverLabels(grpcUnary, "Check", "OK")},
+		{m.grpcServerHandled, serverLabels(grpcUnary, "Check", "NotFound")},
+	} {
+		if got := testutil.ToFloat64(c.vec.With(c.labels)); got != 1 {
+			t.Errorf("%v = %v, want 1", c.labels, got)
+		}
+	}
+	if got := testutil.CollectAndCount(m.grpcClientHandling); got != 2 {
+		t.Errorf("grpc_client_handling_seconds series = %d, want 2", got)
+	}
+	inFlight := clientLabels(grpcUnary, "Check", "")
+	delete(inFlight, "grpc_code")
+	if got := testutil.ToFloat64(m.grpcClientInFlight.With(inFlight)); got != 0 {
+		t.Errorf("grpc_client_in_flight = %v, want 0", got)
+	}
+
+	// The server spans continue the trace of the client spans.
+	spans := map[oteltrace.SpanKind][]string{}
+	for _, s := range sr.Ended() {
+		if s.SpanContext().TraceID() != span.SpanContext().TraceID() {
+			continue
+		}
+		spans[s.SpanKind()] = append(spans[s.SpanKind()], s.Name())
+	}
+	if got := len(spans[oteltrace.SpanKindServer]); got != 2 {
+		t.Errorf("server spans in the trace = %d, want 2", got)
+	}
+	if got := len(spans[oteltrace.SpanKindClient]); got != 2 {
+		t.Errorf("client spans in the trace = %d, want 2", got)
+	}
+}
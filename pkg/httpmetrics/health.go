@@ -0,0 +1,115 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ReadinessCheck reports whether a component of the process is ready to
+// serve, by returning nil.
+type ReadinessCheck func(ctx context.Context) error
+
+// readinessTimeout bounds how long /readyz waits for the checks.
+const readinessTimeout = 5 * time.Second
+
+// errNotReady is reported by the checks of AddReadinessGate until they open.
+var errNotReady = errors.New("not ready")
+
+// AddReadinessCheck registers a check to run on each request to /readyz,
+// replacing any check registered under the same name.
+func AddReadinessCheck(name string, check ReadinessCheck) {
+	defaultMetrics.AddReadinessCheck(name, check)
+}
+
+// AddReadinessCheck registers a check to run on each request to /readyz,
+// replacing any check registered under the same name.
+func (m *Metrics) AddReadinessCheck(name string, check ReadinessCheck) {
+	m.readinessMu.Lock()
+	defer m.readinessMu.Unlock()
+	m.readiness[name] = check
+}
+
+// AddReadinessGate registers a readiness check that fails until the
+// returned function is called, e.g. once a client has been constructed.
+func AddReadinessGate(name string) (ready func()) {
+	return defaultMetrics.AddReadinessGate(name)
+}
+
+// AddReadinessGate registers a readiness check that fails until the
+// returned function is called, e.g. once a client has been constructed.
+func (m *Metrics) AddReadinessGate(name string) (ready func()) {
+	var open atomic.Bool
+	m.AddReadinessCheck(name, func(context.Context) error {
+		if !open.Load() {
+			return errNotReady
+		}
+		return nil
+	})
+	return func() { open.Store(true) }
+}
+
+// checkReadiness runs the readiness checks, and returns their errors by name.
+func (m *Metrics) checkReadiness(ctx context.Context) map[string]error {
+	m.readinessMu.RLock()
+	checks := make(map[string]ReadinessCheck, len(m.readiness))
+	for name, check := range m.readiness {
+		checks[name] = check
+	}
+	m.readinessMu.RUnlock()
+
+	results := make(map[string]error, len(checks))
+	for name, check := range checks {
+		results[name] = check(ctx)
+	}
+	return results
+}
+
+// healthzHandler reports that the process is alive, for liveness probes.
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler runs the readiness checks, and fails with 503 if any of
+// them fail. The body lists the result of every check.
+func (m *Metrics) readyzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		results := m.checkReadiness(ctx)
+		names := make([]string, 0, len(results))
+		ready := true
+		for name, err := range results {
+			names = append(names, name)
+			if err != nil {
+				ready = false
+			}
+		}
+		sort.Strings(names)
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		for _, name := range names {
+			if err := results[name]; err != nil {
+				fmt.Fprintf(w, "[-] %s: %v\n", name, err)
+			} else {
+				fmt.Fprintf(w, "[+] %s: ok\n", name)
+			}
+		}
+		if ready {
+			fmt.Fprintln(w, "ok")
+		}
+	}
+}
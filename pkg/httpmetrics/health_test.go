@@ -0,0 +1,96 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestServeMetricsContext(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	ready := m.AddReadinessGate("client")
+	m.AddReadinessCheck("ok", func(context.Context) error { return nil })
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- m.serveMetrics(ctx, lis, false) }()
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", lis.Addr(), path))
+		if err != nil {
+			t.Fatalf("GET %s = %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz = %d, want %d", code, http.StatusOK)
+	}
+	if code, _ := get("/metrics"); code != http.StatusOK {
+		t.Errorf("/metrics = %d, want %d", code, http.StatusOK)
+	}
+	code, body := get("/readyz")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if want := "[-] client: not ready\n[+] ok: ok\n"; body != want {
+		t.Errorf("/readyz body = %q, want %q", body, want)
+	}
+
+	ready()
+	if code, _ := get("/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz = %d, want %d", code, http.StatusOK)
+	}
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("serveMetrics() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveMetrics() did not return after cancellation")
+	}
+}
+
+func TestServeMetricsContextBindError(t *testing.T) {
+	lis, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Listen() = %v", err)
+	}
+	defer lis.Close()
+	t.Setenv("METRICS_PORT", fmt.Sprint(lis.Addr().(*net.TCPAddr).Port))
+
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	err = m.ServeMetricsContext(context.Background())
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || !strings.Contains(err.Error(), "address already in use") {
+		t.Errorf("ServeMetricsContext() = %v, want bind error", err)
+	}
+}
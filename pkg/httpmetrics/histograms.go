@@ -0,0 +1,282 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// DefaultDurationBuckets are the buckets used for the server and client
+	// request duration histograms unless configured otherwise.
+	DefaultDurationBuckets = []float64{.25, .5, 1, 2.5, 5, 10, 20, 30, 45, 60}
+
+	// DefaultResponseSizeBuckets are the buckets used for the server response
+	// size histogram unless configured otherwise.
+	DefaultResponseSizeBuckets = []float64{200, 500, 900, 1500}
+
+	// DefaultClientSizeBuckets are the buckets used for the client request
+	// and response body size histograms unless configured otherwise. They
+	// span 256B to 64MiB, since clients also upload and download blobs.
+	DefaultClientSizeBuckets = prometheus.ExponentialBuckets(256, 4, 10)
+
+	// DefaultClientPhaseBuckets are the buckets used for the client
+	// connection phase histograms of WithConnectionTrace unless configured
+	// otherwise. DNS, connect and TLS typically take milliseconds.
+	DefaultClientPhaseBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+	// DefaultDeliveryLatencyBuckets are the buckets used for the CloudEvent
+	// delivery latency histogram unless configured otherwise. They reach
+	// up to a day, for events stuck in a backlog.
+	DefaultDeliveryLatencyBuckets = []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600, 4 * 3600, 24 * 3600}
+
+	// deliveryAttemptBuckets are the buckets of the Pub/Sub delivery attempt
+	// histogram. Dead letter policies allow from 5 to 100 attempts.
+	deliveryAttemptBuckets = []float64{1, 2, 3, 4, 5, 10, 20, 50, 100}
+
+	// ErrHistogramsInUse is returned by ConfigureHistograms once the
+	// histograms have been created by the first call to Handler or the first
+	// request through WrapTransport.
+	ErrHistogramsInUse = errors.New("httpmetrics: histograms are already in use")
+)
+
+// histogramConfig holds the bucket layout for each histogram family.
+// Each of these can be overridden by the environment, which takes precedence
+// over the options passed to ConfigureHistograms.
+type histogramConfig struct {
+	ServerDuration  []float64 `envconfig:"HTTP_REQUEST_DURATION_BUCKETS"`
+	ResponseSize    []float64 `envconfig:"HTTP_RESPONSE_SIZE_BUCKETS"`
+	ClientDuration  []float64 `envconfig:"HTTP_CLIENT_REQUEST_DURATION_BUCKETS"`
+	ClientSize      []float64 `envconfig:"HTTP_CLIENT_SIZE_BUCKETS"`
+	ClientPhase     []float64 `envconfig:"HTTP_CLIENT_PHASE_DURATION_BUCKETS"`
+	DeliveryLatency []float64 `envconfig:"CLOUDEVENT_DELIVERY_LATENCY_BUCKETS"`
+
+	// NativeBucketFactor enables native (sparse) histograms when > 1.
+	NativeBucketFactor float64 `envconfig:"HTTP_NATIVE_HISTOGRAM_BUCKET_FACTOR"`
+}
+
+// HistogramOption configures the histograms recorded by this package.
+type HistogramOption func(*histogramConfig)
+
+// WithServerDurationBuckets sets the buckets of http_request_duration_seconds.
+func WithServerDurationBuckets(buckets ...float64) HistogramOption {
+	return func(c *histogramConfig) { c.ServerDuration = buckets }
+}
+
+// WithResponseSizeBuckets sets the buckets of http_response_size_bytes.
+func WithResponseSizeBuckets(buckets ...float64) HistogramOption {
+	return func(c *histogramConfig) { c.ResponseSize = buckets }
+}
+
+// WithClientDurationBuckets sets the buckets of http_client_request_duration_seconds.
+func WithClientDurationBuckets(buckets ...float64) HistogramOption {
+	return func(c *histogramConfig) { c.ClientDuration = buckets }
+}
+
+// WithClientSizeBuckets sets the buckets of http_client_request_size_bytes
+// and http_client_response_size_bytes.
+func WithClientSizeBuckets(buckets ...float64) HistogramOption {
+	return func(c *histogramConfig) { c.ClientSize = buckets }
+}
+
+// WithClientPhaseBuckets sets the buckets of the connection phase
+// histograms recorded by WithConnectionTrace.
+func WithClientPhaseBuckets(buckets ...float64) HistogramOption {
+	return func(c *histogramConfig) { c.ClientPhase = buckets }
+}
+
+// WithDeliveryLatencyBuckets sets the buckets of
+// cloudevent_delivery_latency_seconds.
+func WithDeliveryLatencyBuckets(buckets ...float64) HistogramOption {
+	return func(c *histogramConfig) { c.DeliveryLatency = buckets }
+}
+
+// WithNativeHistograms opts into Prometheus native (sparse) histograms, which
+// are exposed alongside the classic buckets. The factor is the maximum ratio
+// between the upper bounds of consecutive buckets, and must be > 1 (e.g. 1.1).
+// See https://pkg.go.dev/github.com/prometheus/client_golang/prometheus#HistogramOpts
+func WithNativeHistograms(factor float64) HistogramOption {
+	return func(c *histogramConfig) { c.NativeBucketFactor = factor }
+}
+
+// ConfigureHistograms sets the bucket layouts of the histograms recorded by
+// the package-level functions. It must be called before the first call to
+// Handler and before the first request through WrapTransport, and returns
+// ErrHistogramsInUse otherwise. See WithHistograms for NewMetrics.
+func ConfigureHistograms(opts ...HistogramOption) error {
+	return defaultMetrics.configureHistograms(opts...)
+}
+
+func (m *Metrics) configureHistograms(opts ...HistogramOption) error {
+	m.histogramsMu.Lock()
+	defer m.histogramsMu.Unlock()
+	if m.histogramsCreated {
+		return ErrHistogramsInUse
+	}
+	cfg := m.histograms
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	m.histograms = cfg
+	return nil
+}
+
+func (c *histogramConfig) applyEnv() error {
+	var override histogramConfig
+	if err := envconfig.Process("", &override); err != nil {
+		return err
+	}
+	if err := override.validate(); err != nil {
+		return err
+	}
+	if len(override.ServerDuration) > 0 {
+		c.ServerDuration = override.ServerDuration
+	}
+	if len(override.ResponseSize) > 0 {
+		c.ResponseSize = override.ResponseSize
+	}
+	if len(override.ClientDuration) > 0 {
+		c.ClientDuration = override.ClientDuration
+	}
+	if len(override.ClientSize) > 0 {
+		c.ClientSize = override.ClientSize
+	}
+	if len(override.ClientPhase) > 0 {
+		c.ClientPhase = override.ClientPhase
+	}
+	if len(override.DeliveryLatency) > 0 {
+		c.DeliveryLatency = override.DeliveryLatency
+	}
+	if override.NativeBucketFactor != 0 {
+		c.NativeBucketFactor = override.NativeBucketFactor
+	}
+	return nil
+}
+
+func (c *histogramConfig) validate() error {
+	for name, buckets := range map[string][]float64{
+		"server duration":  c.ServerDuration,
+		"response size":    c.ResponseSize,
+		"client duration":  c.ClientDuration,
+		"client size":      c.ClientSize,
+		"client phase":     c.ClientPhase,
+		"delivery latency": c.DeliveryLatency,
+	} {
+		for i := 1; i < len(buckets); i++ {
+			if buckets[i] <= buckets[i-1] {
+				return fmt.Errorf("httpmetrics: %s buckets must be in increasing order: %v", name, buckets)
+			}
+		}
+	}
+	if c.NativeBucketFactor != 0 && c.NativeBucketFactor <= 1 {
+		return fmt.Errorf("httpmetrics: native histogram bucket factor must be > 1, got %v", c.NativeBucketFactor)
+	}
+	return nil
+}
+
+func (c *histogramConfig) opts(name, help string, buckets []float64) prometheus.HistogramOpts {
+	opts := prometheus.HistogramOpts{
+		Name:    name,
+		Help:    help,
+		Buckets: buckets,
+	}
+	if c.NativeBucketFactor > 1 {
+		opts.NativeHistogramBucketFactor = c.NativeBucketFactor
+		opts.NativeHistogramMaxBucketNumber = 160
+		opts.NativeHistogramMinResetDuration = time.Hour
+	}
+	return opts
+}
+
+// initHistograms creates and registers the histograms on first use, so that
+// they pick up the layouts from ConfigureHistograms and the environment.
+func (m *Metrics) initHistograms() error {
+	m.histogramsOnce.Do(func() {
+		m.histogramsMu.Lock()
+		defer m.histogramsMu.Unlock()
+		m.histogramsCreated = true
+
+		if err := m.histograms.applyEnv(); err != nil {
+			slog.Warn("Failed to process histogram environment variables", "error", err)
+		}
+
+		m.duration = prometheus.NewHistogramVec(
+			m.histograms.opts("http_request_duration_seconds", "A histogram of latencies for requests.", m.histograms.ServerDuration),
+			[]string{"handler", "method", "service_name", "configuration_name", "revision_name", "route"},
+		)
+		m.responseSize = prometheus.NewHistogramVec(
+			m.histograms.opts("http_response_size_bytes", "A histogram of response sizes for requests.", m.histograms.ResponseSize),
+			[]string{"handler", "method", "service_name", "configuration_name", "revision_name", "route"},
+		)
+		m.mReqDuration = prometheus.NewHistogramVec(
+			m.histograms.opts("http_client_request_duration_seconds", "The duration of HTTP requests", m.histograms.ClientDuration),
+			[]string{"code", "method", "host", "service_name", "configuration_name", "revision_name", "ce_type", "operation"},
+		)
+		m.mReqSize = prometheus.NewHistogramVec(
+			m.histograms.opts("http_client_request_size_bytes", "A histogram of the body sizes of HTTP requests", m.histograms.ClientSize),
+			[]string{"method", "host", "service_name", "configuration_name", "revision_name", "ce_type"},
+		)
+		m.mRespSize = prometheus.NewHistogramVec(
+			m.histograms.opts("http_client_response_size_bytes", "A histogram of the body sizes of HTTP responses", m.histograms.ClientSize),
+			[]string{"code", "method", "host", "service_name", "configuration_name", "revision_name", "ce_type"},
+		)
+		phaseLabels := []string{"host", "service_name", "configuration_name", "revision_name"}
+		m.mReqDNS = prometheus.NewHistogramVec(
+			m.histograms.opts("http_client_dns_duration_seconds", "The duration of DNS lookups for HTTP requests", m.histograms.ClientPhase),
+			phaseLabels,
+		)
+		m.mReqConnect = prometheus.NewHistogramVec(
+			m.histograms.opts("http_client_connect_duration_seconds", "The duration of establishing connections for HTTP requests", m.histograms.ClientPhase),
+			phaseLabels,
+		)
+		m.mReqTLS = prometheus.NewHistogramVec(
+			m.histograms.opts("http_client_tls_duration_seconds", "The duration of TLS handshakes for HTTP requests", m.histograms.ClientPhase),
+			phaseLabels,
+		)
+		m.mReqTTFB = prometheus.NewHistogramVec(
+			m.histograms.opts("http_client_time_to_first_byte_seconds", "The time from writing HTTP requests to the first byte of their response", m.histograms.ClientPhase),
+			phaseLabels,
+		)
+		deliveryLabels := []string{"handler", "ce_type", "service_name", "configuration_name", "revision_name"}
+		m.deliveryLatency = prometheus.NewHistogramVec(
+			m.histograms.opts("cloudevent_delivery_latency_seconds", "The time from the ce-time of CloudEvents to their delivery to the handler", m.histograms.DeliveryLatency),
+			deliveryLabels,
+		)
+		m.deliveryAttempts = prometheus.NewHistogramVec(
+			m.histograms.opts("pubsub_delivery_attempts", "The Pub/Sub delivery attempt of the requests to the handler", deliveryAttemptBuckets),
+			deliveryLabels,
+		)
+		m.grpcServerHandling = prometheus.NewHistogramVec(
+			m.histograms.opts("grpc_server_handling_seconds", "A histogram of latencies for RPCs handled by the server.", m.histograms.ServerDuration),
+			[]string{"grpc_type", "grpc_service", "grpc_method", "service_name", "configuration_name", "revision_name"},
+		)
+		m.grpcClientHandling = prometheus.NewHistogramVec(
+			m.histograms.opts("grpc_client_handling_seconds", "A histogram of latencies for RPCs made by the client.", m.histograms.ClientDuration),
+			[]string{"grpc_type", "grpc_service", "grpc_method", "host", "service_name", "configuration_name", "revision_name"},
+		)
+		m.histogramsErr = m.register(m.duration, m.responseSize, m.mReqDuration, m.mReqSize, m.mRespSize,
+			m.mReqDNS, m.mReqConnect, m.mReqTLS, m.mReqTTFB, m.deliveryLatency, m.deliveryAttempts, m.grpcServerHandling, m.grpcClientHandling)
+	})
+	return m.histogramsErr
+}
+
+// mustInitHistograms is initHistograms for the request path. This can only
+// fail for the default instance, if something else registered our metric
+// names with the default registry, which promauto would have panicked on.
+func (m *Metrics) mustInitHistograms() {
+	if err := m.initHistograms(); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHistogramConfig(t *testing.T) {
+	cfg := histogramConfig{
+		ServerDuration: DefaultDurationBuckets,
+		ResponseSize:   DefaultResponseSizeBuckets,
+		ClientDuration: DefaultDurationBuckets,
+	}
+	for _, opt := range []HistogramOption{
+		WithServerDurationBuckets(.005, .01, .05, .1),
+		WithResponseSizeBuckets(1e3, 1e4, 1e5),
+		WithNativeHistograms(1.1),
+	} {
+		opt(&cfg)
+	}
+
+	t.Setenv("HTTP_RESPONSE_SIZE_BUCKETS", "100,1000,10000,100000")
+	t.Setenv("HTTP_CLIENT_REQUEST_DURATION_BUCKETS", "0.1,1,10")
+	if err := cfg.applyEnv(); err != nil {
+		t.Fatalf("applyEnv() = %v", err)
+	}
+
+	if diff := cmp.Diff([]float64{.005, .01, .05, .1}, cfg.ServerDuration); diff != "" {
+		t.Errorf("server duration buckets (-want +got): %s", diff)
+	}
+	if diff := cmp.Diff([]float64{100, 1000, 10000, 100000}, cfg.ResponseSize); diff != "" {
+		t.Errorf("response size buckets (-want +got): %s", diff)
+	}
+	if diff := cmp.Diff([]float64{.1, 1, 10}, cfg.ClientDuration); diff != "" {
+		t.Errorf("client duration buckets (-want +got): %s", diff)
+	}
+
+	opts := cfg.opts("test", "help", cfg.ServerDuration)
+	if opts.NativeHistogramBucketFactor != 1.1 {
+		t.Errorf("NativeHistogramBucketFactor = %v, want 1.1", opts.NativeHistogramBucketFactor)
+	}
+}
+
+func TestHistogramConfigValidate(t *testing.T) {
+	for _, opt := range []HistogramOption{
+		WithServerDurationBuckets(1, 1),
+		WithClientDurationBuckets(2, 1),
+		WithNativeHistograms(0.5),
+	} {
+		var cfg histogramConfig
+		opt(&cfg)
+		if err := cfg.validate(); err == nil {
+			t.Errorf("validate(%+v) = nil, wanted error", cfg)
+		}
+	}
+
+	t.Setenv("HTTP_REQUEST_DURATION_BUCKETS", "5,1")
+	var cfg histogramConfig
+	if err := cfg.applyEnv(); err == nil {
+		t.Error("applyEnv() = nil, wanted error")
+	}
+}
+
+func TestConfigureHistogramsInUse(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	if err := m.configureHistograms(WithNativeHistograms(1.1)); !errors.Is(err, ErrHistogramsInUse) {
+		t.Errorf("configureHistograms() = %v, want %v", err, ErrHistogramsInUse)
+	}
+}
+
+func TestWithHistograms(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := NewMetrics(reg, WithHistograms(WithClientDurationBuckets(.01, .1, 1)))
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	m.mReqDuration.WithLabelValues("200", "GET", "other", "", "", "", "", "").Observe(.05)
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() = %v", err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "http_client_request_duration_seconds" {
+			continue
+		}
+		var got []float64
+		for _, b := range mf.GetMetric()[0].GetHistogram().GetBucket() {
+			got = append(got, b.GetUpperBound())
+		}
+		if diff := cmp.Diff([]float64{.01, .1, 1}, got); diff != "" {
+			t.Errorf("buckets (-want +got): %s", diff)
+		}
+		return
+	}
+	t.Error("http_client_request_duration_seconds was not registered")
+}
+
+func TestNewMetricsInvalidHistograms(t *testing.T) {
+	if _, err := NewMetrics(prometheus.NewRegistry(), WithHistograms(WithResponseSizeBuckets(2, 1))); err == nil {
+		t.Error("NewMetrics() = nil, wanted error")
+	}
+}
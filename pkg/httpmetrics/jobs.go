@@ -0,0 +1,32 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newJobCollectors creates the info metric of the task of a Cloud Run job,
+// which is only set in jobs. Its labels are too fine-grained for the other
+// metrics, but dashboards can join them with it on service_name.
+func (m *Metrics) newJobCollectors() {
+	m.jobTaskInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cloud_run_job_task_info",
+			Help: "Information about the Cloud Run job task of this process, always 1",
+		},
+		[]string{"service_name", "configuration_name", "revision_name", "task_index", "task_attempt"},
+	)
+	if env.CloudRun.Job != "" {
+		m.jobTaskInfo.With(prometheus.Labels{
+			"service_name":       env.KnativeServiceName,
+			"configuration_name": env.KnativeConfigurationName,
+			"revision_name":      env.KnativeRevisionName,
+			"task_index":         env.CloudRun.TaskIndex,
+			"task_attempt":       env.CloudRun.TaskAttempt,
+		}).Set(1)
+	}
+}
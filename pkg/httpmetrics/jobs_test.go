@@ -0,0 +1,101 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoadLabelEnv(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		env  map[string]string
+		want labelEnv
+	}{{
+		name: "local",
+		want: labelEnv{
+			KnativeServiceName:       "unknown",
+			KnativeConfigurationName: "unknown",
+			KnativeRevisionName:      "unknown",
+		},
+	}, {
+		name: "service",
+		env: map[string]string{
+			"K_SERVICE":       "svc",
+			"K_CONFIGURATION": "svc",
+			"K_REVISION":      "svc-00001-abc",
+		},
+		want: labelEnv{
+			KnativeServiceName:       "svc",
+			KnativeConfigurationName: "svc",
+			KnativeRevisionName:      "svc-00001-abc",
+			CloudRun: cloudRunEnv{
+				Service:       "svc",
+				Configuration: "svc",
+				Revision:      "svc-00001-abc",
+			},
+		},
+	}, {
+		name: "job",
+		env: map[string]string{
+			"CLOUD_RUN_JOB":          "cron",
+			"CLOUD_RUN_EXECUTION":    "cron-xyz12",
+			"CLOUD_RUN_TASK_INDEX":   "0",
+			"CLOUD_RUN_TASK_ATTEMPT": "1",
+		},
+		want: labelEnv{
+			KnativeServiceName:       "cron",
+			KnativeConfigurationName: "cron",
+			KnativeRevisionName:      "cron",
+			CloudRun: cloudRunEnv{
+				Job:         "cron",
+				Execution:   "cron-xyz12",
+				TaskIndex:   "0",
+				TaskAttempt: "1",
+			},
+		},
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			for _, k := range []string{"K_SERVICE", "K_CONFIGURATION", "K_REVISION", "CLOUD_RUN_JOB", "CLOUD_RUN_EXECUTION", "CLOUD_RUN_TASK_INDEX", "CLOUD_RUN_TASK_ATTEMPT"} {
+				t.Setenv(k, c.env[k])
+			}
+			if diff := cmp.Diff(c.want, loadLabelEnv()); diff != "" {
+				t.Errorf("loadLabelEnv() (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestJobTaskInfo(t *testing.T) {
+	prev := env
+	defer func() { env = prev }()
+	t.Setenv("CLOUD_RUN_JOB", "cron")
+	t.Setenv("CLOUD_RUN_EXECUTION", "cron-xyz12")
+	t.Setenv("CLOUD_RUN_TASK_INDEX", "3")
+	t.Setenv("CLOUD_RUN_TASK_ATTEMPT", "0")
+	env = loadLabelEnv()
+
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	if got := testutil.ToFloat64(m.jobTaskInfo.With(prometheus.Labels{
+		"service_name":       "cron",
+		"configuration_name": "cron",
+		"revision_name":      "cron",
+		"task_index":         "3",
+		"task_attempt":       "0",
+	})); got != 1 {
+		t.Errorf("cloud_run_job_task_info = %v, want 1", got)
+	}
+	if got := testutil.CollectAndCount(m.jobTaskInfo); got != 1 {
+		t.Errorf("cloud_run_job_task_info series = %d, want 1", got)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/chainguard-dev/clog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The special fields with which Cloud Logging correlates log lines with traces.
+// See https://cloud.google.com/logging/docs/structured-logging#special-payload-fields
+const (
+	logTraceKey        = "logging.googleapis.com/trace"
+	logSpanIDKey       = "logging.googleapis.com/spanId"
+	logTraceSampledKey = "logging.googleapis.com/trace_sampled"
+)
+
+// cloudProject returns the project to which traces are exported, from
+// GOOGLE_CLOUD_PROJECT or else the metadata server.
+var cloudProject = sync.OnceValue(func() string {
+	if p := os.Getenv("GOOGLE_CLOUD_PROJECT"); p != "" {
+		return p
+	}
+	// Only ask the metadata server where there is one, since elsewhere the
+	// request can take a while to fail.
+	if os.Getenv("GCE_METADATA_HOST") == "" && os.Getenv("K_SERVICE") == "" && os.Getenv("CLOUD_RUN_JOB") == "" {
+		return ""
+	}
+	p, err := metadata.ProjectID()
+	if err != nil {
+		slog.Warn("Failed to get project ID from the metadata server, logs won't be correlated with traces", "error", err)
+		return ""
+	}
+	return p
+})
+
+// withTraceLogger puts a clog logger on the context whose lines Cloud
+// Logging correlates with the span of the context, if there is one.
+func withTraceLogger(ctx context.Context) context.Context {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return ctx
+	}
+	project := cloudProject()
+	if project == "" {
+		return ctx
+	}
+	return clog.WithLogger(ctx, clog.FromContext(ctx).With(
+		logTraceKey, "projects/"+project+"/traces/"+sc.TraceID().String(),
+		logSpanIDKey, sc.SpanID().String(),
+		logTraceSampledKey, sc.IsSampled(),
+	))
+}
+
+// traceLogger makes clog.FromContext within the handler log with the trace
+// of its server span.
+func traceLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(withTraceLogger(r.Context())))
+	})
+}
+
+// traceLoggerTransport makes clog.FromContext below it log with the trace of
+// the client span, as do the retries and throttling of WrapTransport, and
+// logs the errors of the requests.
+func traceLoggerTransport(next http.RoundTripper) promhttp.RoundTripperFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		ctx := withTraceLogger(r.Context())
+		resp, err := next.RoundTrip(r.WithContext(ctx))
+		if err != nil && ctx.Err() == nil {
+			clog.FromContext(ctx).WarnContext(ctx, "Request failed", "method", r.Method, "host", r.URL.Host, "path", r.URL.Path, "error", err)
+		}
+		return resp, err
+	}
+}
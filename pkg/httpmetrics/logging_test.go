@@ -0,0 +1,159 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceLogger(t *testing.T) {
+	tp := trace.NewTracerProvider()
+	defer tp.Shutdown(context.Background())
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	prevProject := cloudProject
+	cloudProject = func() string { return "my-project" }
+	defer func() { cloudProject = prevProject }()
+
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+
+	// logLine logs from the context and returns the Cloud Logging fields
+	// of the line, along with those expected from its span.
+	var buf bytes.Buffer
+	ctx := clog.WithLogger(context.Background(), clog.New(slog.NewJSONHandler(&buf, nil)))
+	logLine := func(ctx context.Context) (got, want map[string]any) {
+		buf.Reset()
+		clog.FromContext(ctx).InfoContext(ctx, "hello")
+		var line map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+			t.Fatalf("Unmarshal() = %v", err)
+		}
+		got = map[string]any{}
+		for k, v := range line {
+			if strings.HasPrefix(k, "logging.googleapis.com/") {
+				got[k] = v
+			}
+		}
+		sc := oteltrace.SpanContextFromContext(ctx)
+		return got, map[string]any{
+			logTraceKey:        "projects/my-project/traces/" + sc.TraceID().String(),
+			logSpanIDKey:       sc.SpanID().String(),
+			logTraceSampledKey: true,
+		}
+	}
+
+	t.Run("handler", func(t *testing.T) {
+		var got, want map[string]any
+		h := m.Handler("logs", http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			got, want = logLine(r.Context())
+		}))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("log fields (-want +got): %s", diff)
+		}
+	})
+
+	t.Run("transport", func(t *testing.T) {
+		// The wrapped transport logs with the trace of the client span...
+		var got, want map[string]any
+		client := &http.Client{Transport: m.WrapTransport(promhttp.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if !oteltrace.SpanContextFromContext(r.Context()).IsValid() {
+				t.Error("wrapped transport has no client span")
+			}
+			got, want = logLine(r.Context())
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+		}))}
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Do() = %v", err)
+		}
+		resp.Body.Close()
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("log fields (-want +got): %s", diff)
+		}
+
+		// ...but the caller's logger is left alone.
+		if got, _ := logLine(req.Context()); len(got) != 0 {
+			t.Errorf("caller log fields = %v, want none", got)
+		}
+	})
+
+	t.Run("retries and errors", func(t *testing.T) {
+		var sc oteltrace.SpanContext
+		calls := 0
+		client := &http.Client{Transport: m.WrapTransport(promhttp.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			sc = oteltrace.SpanContextFromContext(r.Context())
+			calls++
+			if calls == 1 {
+				return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+			}
+			return nil, errors.New("connection refused")
+		}), WithRetries(WithMaxRetries(1), WithRetryBackoff(time.Millisecond, time.Millisecond)))}
+
+		buf.Reset()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/", nil)
+		if _, err := client.Do(req); err == nil {
+			t.Fatal("Do() = nil, wanted error")
+		}
+
+		// Each line is correlated with the client span of the request.
+		want := map[string]any{
+			logTraceKey:        "projects/my-project/traces/" + sc.TraceID().String(),
+			logSpanIDKey:       sc.SpanID().String(),
+			logTraceSampledKey: true,
+		}
+		var msgs []string
+		for _, l := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+			var line map[string]any
+			if err := json.Unmarshal(l, &line); err != nil {
+				t.Fatalf("Unmarshal() = %v", err)
+			}
+			msgs = append(msgs, line["msg"].(string))
+			got := map[string]any{}
+			for k, v := range line {
+				if strings.HasPrefix(k, "logging.googleapis.com/") {
+					got[k] = v
+				}
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("%s: log fields (-want +got): %s", line["msg"], diff)
+			}
+		}
+		if diff := cmp.Diff([]string{"Retrying request", "Giving up on request after retries", "Request failed"}, msgs); diff != "" {
+			t.Errorf("messages (-want +got): %s", diff)
+		}
+	})
+
+	t.Run("no span", func(t *testing.T) {
+		if got := withTraceLogger(ctx); got != ctx {
+			t.Error("withTraceLogger() changed the context without a span")
+		}
+	})
+}
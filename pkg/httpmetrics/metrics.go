@@ -2,9 +2,11 @@ package httpmetrics
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"strconv"
@@ -13,36 +15,90 @@ import (
 	"github.com/chainguard-dev/clog"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	otelprom "go.opentelemetry.io/contrib/bridges/prometheus"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/propagation"
-	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/trace"
 )
 
 // ServeMetrics serves the metrics endpoint if the METRICS_PORT env var is set.
+// It blocks until the server fails, see ServeMetricsContext.
 func ServeMetrics() {
+	defaultMetrics.ServeMetrics()
+}
+
+// ServeMetrics serves the metrics endpoint if the METRICS_PORT env var is set.
+// It blocks until the server fails, see ServeMetricsContext.
+func (m *Metrics) ServeMetrics() {
+	if err := m.ServeMetricsContext(context.Background()); err != nil {
+		slog.Error("listen and serve for http /metrics", "error", err)
+	}
+}
+
+// ServeMetricsContext serves /metrics, /healthz and /readyz (and pprof, if
+// ENABLE_PPROF is set) on METRICS_PORT until the context is cancelled, and
+// then shuts down gracefully. It returns an error if the port can't be
+// bound, so callers should run it in a goroutine and log the result, rather
+// than take down the service with it:
+//
+//	go func() {
+//		if err := httpmetrics.ServeMetricsContext(ctx); err != nil {
+//			clog.FromContext(ctx).Errorf("ServeMetricsContext() = %v", err)
+//		}
+//	}()
+func ServeMetricsContext(ctx context.Context) error {
+	return defaultMetrics.ServeMetricsContext(ctx)
+}
+
+// ServeMetricsContext serves /metrics, /healthz and /readyz (and pprof, if
+// ENABLE_PPROF is set) on METRICS_PORT until the context is cancelled, and
+// then shuts down gracefully. It returns an error if the port can't be bound.
+func (m *Metrics) ServeMetricsContext(ctx context.Context) error {
+	if m.gatherer == nil {
+		return errors.New("httpmetrics: ServeMetrics requires a prometheus.Gatherer, see WithGatherer")
+	}
 	// Start the metrics server on the metrics port, if defined.
 	var env struct {
 		MetricsPort int  `envconfig:"METRICS_PORT" default:"2112" required:"true"`
 		EnablePprof bool `envconfig:"ENABLE_PPROF" default:"false" required:"true"`
 	}
 	if err := envconfig.Process("", &env); err != nil {
-		slog.Error("Failed to process environment variables", "error", err)
-		return
+		return fmt.Errorf("processing environment variables: %w", err)
 	}
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", env.MetricsPort))
+	if err != nil {
+		return err
+	}
+	return m.serveMetrics(ctx, lis, env.EnablePprof)
+}
+
+// shutdownTimeout bounds how long in-flight scrapes may take to finish once
+// the context passed to ServeMetricsContext is cancelled.
+const shutdownTimeout = 10 * time.Second
+
+func (m *Metrics) serveMetrics(ctx context.Context, lis net.Listener, enablePprof bool) error {
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
+	// OpenMetrics is required to expose the exemplars on our histograms.
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(
+		m.reg,
+		promhttp.HandlerFor(m.gatherer, promhttp.HandlerOpts{
+			EnableOpenMetrics: true,
+		}),
+	))
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.Handle("/readyz", m.readyzHandler())
 	srv := &http.Server{
-		Addr:              fmt.Sprintf(":%d", env.MetricsPort),
 		Handler:           mux,
 		ReadHeaderTimeout: 10 * time.Second,
 	}
 
-	if env.EnablePprof {
+	if enablePprof {
 		// pprof handles
 		mux.HandleFunc("/debug/pprof/", pprof.Index)
 		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -58,90 +114,209 @@ func ServeMetrics() {
 		log.Println("registering handle for /debug/pprof")
 	}
 
-	if err := srv.ListenAndServe(); err != nil {
-		slog.Error("listen and serve for http /metrics", "error", err)
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Serve(lis) }()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
 	}
+	sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		return err
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
-var (
-	inFlightGauge = promauto.NewGaugeVec(
+func (m *Metrics) newServerCollectors() {
+	m.inFlightGauge = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "http_inflight_requests",
 			Help: "A gauge of requests currently being served by the wrapped handler.",
 		},
 		[]string{"handler", "service_name", "configuration_name", "revision_name"},
 	)
-	duration = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name: "http_request_duration_seconds",
-			Help: "A histogram of latencies for requests.",
-			// TODO: tweak bucket values based on real usage.
-			Buckets: []float64{.25, .5, 1, 2.5, 5, 10, 20, 30, 45, 60},
-		},
-		[]string{"handler", "method", "service_name", "configuration_name", "revision_name"},
-	)
-	responseSize = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name: "http_response_size_bytes",
-			Help: "A histogram of response sizes for requests.",
-			// TODO: tweak bucket values based on real usage.
-			Buckets: []float64{200, 500, 900, 1500},
-		},
-		[]string{"handler", "method", "service_name", "configuration_name", "revision_name"},
-	)
-	counter = promauto.NewCounterVec(
+	m.counter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "http_request_status",
 			Help: "The number of processed events by response code",
 		},
-		[]string{"handler", "method", "code", "service_name", "configuration_name", "revision_name", "ce_type"},
+		[]string{"handler", "method", "code", "service_name", "configuration_name", "revision_name", "ce_type", "route"},
 	)
-)
+}
 
-// https://cloud.google.com/run/docs/container-contract#services-env-vars
-var env struct {
-	KnativeServiceName       string `envconfig:"K_SERVICE" default:"unknown"`
-	KnativeConfigurationName string `envconfig:"K_CONFIGURATION" default:"unknown"`
-	KnativeRevisionName      string `envconfig:"K_REVISION" default:"unknown"`
+// cloudRunEnv holds the environment variables that Cloud Run sets in
+// services and jobs.
+// See https://cloud.google.com/run/docs/container-contract#services-env-vars
+// and https://cloud.google.com/run/docs/container-contract#jobs-env-vars
+type cloudRunEnv struct {
+	Service       string `envconfig:"K_SERVICE"`
+	Configuration string `envconfig:"K_CONFIGURATION"`
+	Revision      string `envconfig:"K_REVISION"`
+	Job           string `envconfig:"CLOUD_RUN_JOB"`
+	Execution     string `envconfig:"CLOUD_RUN_EXECUTION"`
+	TaskIndex     string `envconfig:"CLOUD_RUN_TASK_INDEX"`
+	TaskAttempt   string `envconfig:"CLOUD_RUN_TASK_ATTEMPT"`
 }
 
-func init() {
-	if err := envconfig.Process("", &env); err != nil {
+// labelEnv holds the values of the labels that identify this process, and
+// the environment they come from, which newResource shares.
+type labelEnv struct {
+	KnativeServiceName       string
+	KnativeConfigurationName string
+	KnativeRevisionName      string
+
+	CloudRun cloudRunEnv
+}
+
+var env = loadLabelEnv()
+
+// loadLabelEnv reads the labels from the environment. Cloud Run jobs have
+// no revisions, so all three labels are the job, so that cron jobs don't
+// report "unknown". The execution is not a label, since each would start
+// new series of every metric; it is an attribute of the resource instead
+// (see newResource). The task index and attempt are reported by
+// cloud_run_job_task_info.
+func loadLabelEnv() labelEnv {
+	var e labelEnv
+	if err := envconfig.Process("", &e.CloudRun); err != nil {
 		slog.Warn("Failed to process environment variables", "error", err)
 	}
+	e.KnativeServiceName = e.CloudRun.Service
+	e.KnativeConfigurationName = e.CloudRun.Configuration
+	e.KnativeRevisionName = e.CloudRun.Revision
+	if e.KnativeServiceName == "" && e.CloudRun.Job != "" {
+		e.KnativeServiceName = e.CloudRun.Job
+		e.KnativeConfigurationName = e.CloudRun.Job
+		e.KnativeRevisionName = e.CloudRun.Job
+	}
+	for _, v := range []*string{&e.KnativeServiceName, &e.KnativeConfigurationName, &e.KnativeRevisionName} {
+		if *v == "" {
+			*v = "unknown"
+		}
+	}
+	return e
+}
+
+// HandlerOption configures the instrumentation added by Handler.
+type HandlerOption func(*handlerConfig)
+
+type handlerConfig struct {
+	sampler   trace.Sampler
+	maxRoutes int
+	shedding  *sheddingConfig
+	repanic   bool
+	accessLog *accessLogConfig
+}
+
+// Handler wraps a given http handler in standard metrics handlers.
+//
+// The metrics (except for the in-flight gauge) and the server span take the
+// "route" of the request from the pattern with which an http.ServeMux inside
+// or around the handler matched it, or from SetRoute. See WithMaxRoutes.
+//
+// The ServeMux only reports its patterns from Go 1.23, and only with the Go
+// 1.22 patterns enabled. Those are disabled (GODEBUG httpmuxgo121=1) in
+// binaries whose main module declares an older go version, like this one,
+// so their main package needs the directive:
+//
+//	//go:debug httpmuxgo121=0
+//
+// or else the route of every request is empty unless SetRoute is called.
+//
+// Panics of the handler are recovered, logged with their stack and counted
+// by http_handler_panics_total, and answered with a 500, or aborted if the
+// handler had started its response. See WithRepanic.
+//
+// For CloudEvents delivered by Pub/Sub, the time since their ce-time and
+// their delivery attempt are recorded as they arrive.
+//
+// The handler's context carries a clog logger whose lines Cloud Logging
+// correlates with the server span, in the project from GOOGLE_CLOUD_PROJECT
+// or the metadata server.
+func Handler(name string, handler http.Handler, opts ...HandlerOption) http.Handler {
+	return defaultMetrics.Handler(name, handler, opts...)
 }
 
 // Handler wraps a given http handler in standard metrics handlers.
-func Handler(name string, handler http.Handler) http.Handler {
+func (m *Metrics) Handler(name string, handler http.Handler, opts ...HandlerOption) http.Handler {
+	m.mustInitHistograms()
+	var cfg handlerConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
 	labels := prometheus.Labels{
 		"handler":            name,
 		"service_name":       env.KnativeServiceName,
 		"configuration_name": env.KnativeConfigurationName,
 		"revision_name":      env.KnativeRevisionName,
 	}
-	return promhttp.InstrumentHandlerInFlight(
-		inFlightGauge.With(labels),
+	// The span is started outermost, so that the metrics below can attach
+	// its trace ID as an exemplar. The route is only known once the handler
+	// has matched the request, so the in-flight gauge isn't labeled with it.
+	routeOpt := promhttp.WithLabelFromCtx("route", routeLabel)
+	var h http.Handler = promhttp.InstrumentHandlerInFlight(
+		m.inFlightGauge.With(labels),
 		promhttp.InstrumentHandlerDuration(
-			duration.MustCurryWith(labels),
+			m.duration.MustCurryWith(labels),
 			instrumentHandlerCounter(
-				counter.MustCurryWith(labels),
+				m.counter.MustCurryWith(labels),
 				promhttp.InstrumentHandlerResponseSize(
-					responseSize.MustCurryWith(labels),
-					otelhttp.NewHandler(handler, ""),
+					m.responseSize.MustCurryWith(labels),
+					recordRoute(newRouteLimiter(name, cfg.maxRoutes), m.recoverPanics(name, cfg.repanic, labels, handler)),
+					routeOpt,
 				),
 			),
+			promhttp.WithExemplarFromContext(exemplarFromContext),
+			routeOpt,
 		),
 	)
+	// Shed requests are only seen by the span and the access log.
+	if cfg.shedding != nil {
+		h = m.shedLoad(cfg.shedding, labels, h)
+	}
+	if cfg.accessLog != nil {
+		h = accessLog(cfg.accessLog, h)
+	}
+	h = m.observeDelivery(labels, h)
+	h = withRouteHolder(otelhttp.NewHandler(traceLogger(h), name))
+	if cfg.sampler != nil {
+		h = withSampler(cfg.sampler, h)
+	}
+	return h
+}
+
+// Handler wraps a given http handler func in standard metrics handlers.
+func HandlerFunc(name string, f func(http.ResponseWriter, *http.Request), opts ...HandlerOption) http.HandlerFunc {
+	return defaultMetrics.HandlerFunc(name, f, opts...)
 }
 
 // Handler wraps a given http handler func in standard metrics handlers.
-func HandlerFunc(name string, f func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
-	return Handler(name, http.HandlerFunc(f)).ServeHTTP
+func (m *Metrics) HandlerFunc(name string, f func(http.ResponseWriter, *http.Request), opts ...HandlerOption) http.HandlerFunc {
+	return m.Handler(name, http.HandlerFunc(f), opts...).ServeHTTP
 }
 
-// Fractions >= 1 will always sample. Fractions < 0 are treated as zero. To
-// respect the parent trace's `SampledFlag`, the `TraceIDRatioBased` sampler
-// should be used as a delegate of a `Parent` sampler.
+// SetupTracer configures an OTLP/HTTP trace exporter and installs it as the
+// global tracer provider. Spans carry the Cloud Run service (or job), revision,
+// project and region as resource attributes, and trace context is propagated
+// through the X-Cloud-Trace-Context header as well as the W3C headers, so that
+// spans join the traces started by Google's load balancers.
+//
+// Spans are sampled according to OTEL_TRACES_SAMPLER, which is one of
+// always_on, always_off, traceidratio, parentbased_always_on (the default),
+// parentbased_always_off or parentbased_traceidratio. The ratio samplers take
+// their fraction from OTEL_TRACES_SAMPLER_ARG. To respect the parent trace's
+// `SampledFlag`, the `TraceIDRatioBased` sampler should be used as a delegate
+// of a `Parent` sampler, as parentbased_traceidratio does.
+//
+// Handlers can override the sampling of their server spans with
+// WithTraceSampler or WithTraceSampleRatio.
 //
 // Expected usage:
 //
@@ -151,16 +326,27 @@ func SetupTracer(ctx context.Context) func() {
 	if err != nil {
 		clog.FromContext(ctx).Fatalf("SetupTracer() = %v", err)
 	}
+	sampler, err := samplerFromEnv()
+	if err != nil {
+		clog.FromContext(ctx).Fatalf("SetupTracer() = %v", err)
+	}
 	bsp := trace.NewBatchSpanProcessor(traceExporter)
-	res := resource.Default()
+	res, err := newResource(ctx)
+	if err != nil {
+		clog.FromContext(ctx).Fatalf("SetupTracer() = %v", err)
+	}
 
 	tp := trace.NewTracerProvider(
+		trace.WithSampler(handlerSampler{fallback: sampler}),
 		trace.WithResource(res),
 		trace.WithSpanProcessor(bsp),
 	)
 	otel.SetTracerProvider(tp)
 
 	prp := propagation.NewCompositeTextMapPropagator(
+		// This comes first, so that a traceparent header (if any) takes
+		// precedence when extracting.
+		CloudTraceContext{},
 		propagation.TraceContext{},
 		propagation.Baggage{},
 	)
@@ -173,6 +359,71 @@ func SetupTracer(ctx context.Context) func() {
 	}
 }
 
+// SetupMeter configures an OTLP/HTTP exporter that periodically pushes the
+// metrics recorded by this package (along with everything else registered
+// with the default Prometheus registry) to the OTLP receiver of the
+// otel-collector sidecar, on localhost:4318. The sidecar also scrapes
+// ServeMetrics, so a binary should use one or the other: doing both reports
+// every series twice.
+//
+// The exporter is configured through the standard OTEL_EXPORTER_OTLP_* and
+// OTEL_METRIC_EXPORT_INTERVAL environment variables. The returned function
+// flushes any pending metrics and shuts down the exporter.
+//
+// Expected usage:
+//
+//	defer metrics.SetupMeter(ctx)()
+func SetupMeter(ctx context.Context) func() {
+	return defaultMetrics.SetupMeter(ctx)
+}
+
+// SetupMeter is SetupMeter for the metrics in this Metrics' gatherer.
+func (m *Metrics) SetupMeter(ctx context.Context) func() {
+	if m.gatherer == nil {
+		clog.FromContext(ctx).Fatalf("SetupMeter() requires a prometheus.Gatherer, see WithGatherer")
+	}
+	metricExporter, err := otlpmetrichttp.New(ctx)
+	if err != nil {
+		clog.FromContext(ctx).Fatalf("SetupMeter() = %v", err)
+	}
+	reader := metric.NewPeriodicReader(metricExporter,
+		metric.WithProducer(otelprom.NewMetricProducer(
+			otelprom.WithGatherer(withoutSummaries(m.gatherer)),
+		)),
+	)
+	res, err := newResource(ctx)
+	if err != nil {
+		clog.FromContext(ctx).Fatalf("SetupMeter() = %v", err)
+	}
+
+	mp := metric.NewMeterProvider(
+		metric.WithResource(res),
+		metric.WithReader(reader),
+	)
+	otel.SetMeterProvider(mp)
+
+	return func() {
+		if err := mp.Shutdown(context.Background()); err != nil {
+			slog.Error("Error shutting down meter provider", "error", err)
+		}
+	}
+}
+
+// withoutSummaries drops summaries (e.g. go_gc_duration_seconds) from the
+// gathered metrics, as the OTLP exporter can't transform them.
+func withoutSummaries(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		filtered := make([]*dto.MetricFamily, 0, len(mfs))
+		for _, mf := range mfs {
+			if mf.GetType() != dto.MetricType_SUMMARY {
+				filtered = append(filtered, mf)
+			}
+		}
+		return filtered, err
+	})
+}
+
 type delegator struct {
 	http.ResponseWriter
 	Status int
@@ -183,6 +434,17 @@ func (d *delegator) WriteHeader(status int) {
 	d.ResponseWriter.WriteHeader(status)
 }
 
+// Flush implements http.Flusher, so that the promhttp instrumentation
+// around the delegator doesn't hide it from streaming handlers.
+func (d *delegator) Flush() {
+	http.NewResponseController(d.ResponseWriter).Flush() //nolint:errcheck
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (d *delegator) Unwrap() http.ResponseWriter {
+	return d.ResponseWriter
+}
+
 func instrumentHandlerCounter(counter *prometheus.CounterVec, next http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		d := &delegator{
@@ -195,6 +457,7 @@ func instrumentHandlerCounter(counter *prometheus.CounterVec, next http.Handler)
 			"method":  r.Method,
 			"code":    strconv.Itoa(d.Status),
 			"ce_type": r.Header.Get(CeTypeHeader),
+			"route":   routeLabel(r.Context()),
 		}).Inc()
 	}
 }
@@ -1,20 +1,32 @@
 package httpmetrics
 
 import (
+	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestServerMetrics(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
 	handler := "test"
-	http.Handle("/", Handler(handler, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+	mux.Handle("/", m.Handler(handler, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})))
-	srv := httptest.NewServer(http.DefaultServeMux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
 
 	resp, err := srv.Client().Get(srv.URL + "/")
 	if err != nil {
@@ -25,7 +37,7 @@ func TestServerMetrics(t *testing.T) {
 	}
 
 	// Sample a metric to make sure labels are being properly applied.
-	if got := testutil.ToFloat64(counter.MustCurryWith(prometheus.Labels{
+	if got := testutil.ToFloat64(m.counter.MustCurryWith(prometheus.Labels{
 		"handler": handler,
 		"method":  "get",
 		"code":    "200",
@@ -81,3 +93,76 @@ func TestBucketize(t *testing.T) {
 		}
 	}
 }
+
+func TestSetupMeter(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		seen = map[string][]map[string]string{}
+	)
+	// A stand-in for the OTLP/HTTP receiver of the otel-collector sidecar.
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("ReadAll() = %v", err)
+		}
+		var req colmetricpb.ExportMetricsServiceRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Errorf("Unmarshal() = %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rm := range req.GetResourceMetrics() {
+			for _, sm := range rm.GetScopeMetrics() {
+				for _, m := range sm.GetMetrics() {
+					for _, dp := range m.GetGauge().GetDataPoints() {
+						attrs := map[string]string{}
+						for _, kv := range dp.GetAttributes() {
+							attrs[kv.GetKey()] = kv.GetValue().GetStringValue()
+						}
+						seen[m.GetName()] = append(seen[m.GetName()], attrs)
+					}
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", receiver.URL)
+
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	shutdown := m.SetupMeter(context.Background())
+
+	// Creating the handler creates its in-flight series.
+	m.Handler("meter-test", http.NotFoundHandler())
+	m.mGitHubRateLimit.With(prometheus.Labels{"host": "api.github.com", "resource": "meter-test"}).Set(5000)
+
+	// Shutting down flushes the metrics to the receiver.
+	shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for name, want := range map[string]map[string]string{
+		"http_inflight_requests": {
+			"handler":            "meter-test",
+			"service_name":       env.KnativeServiceName,
+			"configuration_name": env.KnativeConfigurationName,
+			"revision_name":      env.KnativeRevisionName,
+		},
+		"github_rate_limit": {"host": "api.github.com", "resource": "meter-test"},
+	} {
+		found := false
+		for _, got := range seen[name] {
+			found = found || cmp.Equal(want, got)
+		}
+		if !found {
+			t.Errorf("%q was not exported with %v, got: %v", name, want, seen[name])
+		}
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"net/http"
+	"slices"
+)
+
+// otherOperation is the operation of requests whose operation isn't
+// allowlisted.
+const otherOperation = "other"
+
+type operationKey struct{}
+
+// WithOperation sets the "operation" label of the client request count,
+// in-flight and duration metrics of the requests made with the context, to
+// break down the requests to one host, e.g. "list-pulls" and
+// "create-check-run". The operation must be allowlisted on the transport
+// with WithOperations, or it is labeled "other".
+func WithOperation(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, operationKey{}, name)
+}
+
+// WithOperations allowlists the operations (see WithOperation) that
+// WrapTransport labels its metrics with, to bound their cardinality.
+func WithOperations(names ...string) TransportOption {
+	return func(c *transportConfig) { c.operations = append(c.operations, names...) }
+}
+
+type operationAllowlist []string
+
+// label returns the "operation" label of the request.
+func (ops operationAllowlist) label(r *http.Request) string {
+	op, ok := r.Context().Value(operationKey{}).(string)
+	switch {
+	case !ok || op == "":
+		return ""
+	case slices.Contains(ops, op):
+		return op
+	default:
+		return otherOperation
+	}
+}
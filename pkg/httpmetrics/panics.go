@@ -0,0 +1,75 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithRepanic makes Handler re-panic after recording a panic of the
+// wrapped handler, instead of responding with a 500, so that tests fail
+// loudly.
+func WithRepanic() HandlerOption {
+	return func(c *handlerConfig) { c.repanic = true }
+}
+
+func (m *Metrics) newPanicCollectors() {
+	m.mPanics = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_handler_panics_total",
+			Help: "The number of panics recovered from the wrapped handler",
+		},
+		[]string{"handler", "service_name", "configuration_name", "revision_name"},
+	)
+}
+
+// recoverPanics responds to requests whose handler panics with a 500, if
+// nothing was written yet, so that the metrics around it see the request.
+// Once the handler has written part of its response, it can't be turned into
+// an error, so the panic is recorded and the response aborted with
+// http.ErrAbortHandler, lest the client take it as complete. As with
+// net/http, http.ErrAbortHandler aborts the response silently.
+func (m *Metrics) recoverPanics(name string, repanic bool, labels prometheus.Labels, next http.Handler) http.Handler {
+	panics := m.mPanics.With(labels)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &recordingWriter{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			panics.Inc()
+
+			ctx := r.Context()
+			span := trace.SpanFromContext(ctx)
+			span.SetStatus(codes.Error, fmt.Sprint("panic: ", p))
+			args := []any{"handler", name, "panic", p, "stack", string(debug.Stack())}
+			if sc := span.SpanContext(); sc.IsValid() {
+				args = append(args, "trace_id", sc.TraceID().String())
+			}
+			clog.FromContext(ctx).ErrorContext(ctx, "Recovered from panic in handler", args...)
+
+			if repanic {
+				panic(p)
+			}
+			if rw.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHandlerPanics(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	boom := http.HandlerFunc(func(http.ResponseWriter, *http.Request) { panic("boom") })
+
+	rec := httptest.NewRecorder()
+	m.Handler("panics", boom).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+
+	labels := prometheus.Labels{
+		"handler":            "panics",
+		"service_name":       env.KnativeServiceName,
+		"configuration_name": env.KnativeConfigurationName,
+		"revision_name":      env.KnativeRevisionName,
+	}
+	if got := testutil.ToFloat64(m.mPanics.With(labels)); got != 1 {
+		t.Errorf("http_handler_panics_total = %v, want 1", got)
+	}
+	// The request is counted, rather than lost with the connection.
+	if got := testutil.ToFloat64(m.counter.With(prometheus.Labels{
+		"handler":            "panics",
+		"method":             http.MethodGet,
+		"code":               "500",
+		"service_name":       env.KnativeServiceName,
+		"configuration_name": env.KnativeConfigurationName,
+		"revision_name":      env.KnativeRevisionName,
+		"ce_type":            "",
+		"route":              "",
+	})); got != 1 {
+		t.Errorf("http_request_status{code=500} = %v, want 1", got)
+	}
+
+	t.Run("repanic", func(t *testing.T) {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Errorf("recover() = %v, want boom", p)
+			}
+			if got := testutil.ToFloat64(m.mPanics.With(labels)); got != 2 {
+				t.Errorf("http_handler_panics_total = %v, want 2", got)
+			}
+		}()
+		m.Handler("panics", boom, WithRepanic()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Errorf("recover() = %v, want http.ErrAbortHandler", p)
+			}
+		}()
+		m.Handler("abort", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			panic(http.ErrAbortHandler)
+		})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+
+	t.Run("partial write", func(t *testing.T) {
+		srv := httptest.NewServer(m.Handler("partial", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Write([]byte("partial")) //nolint:errcheck
+			w.(http.Flusher).Flush()
+			panic("boom")
+		})))
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("Get() = %v", err)
+		}
+		defer resp.Body.Close()
+		// The connection is aborted, so the truncated body isn't mistaken for
+		// a complete response.
+		if body, err := io.ReadAll(resp.Body); err == nil {
+			t.Errorf("ReadAll() = %q, wanted error", body)
+		}
+		if got := testutil.ToFloat64(m.mPanics.With(prometheus.Labels{
+			"handler":            "partial",
+			"service_name":       env.KnativeServiceName,
+			"configuration_name": env.KnativeConfigurationName,
+			"revision_name":      env.KnativeRevisionName,
+		})); got != 1 {
+			t.Errorf("http_handler_panics_total = %v, want 1", got)
+		}
+	})
+}
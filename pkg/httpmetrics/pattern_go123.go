@@ -0,0 +1,16 @@
+//go:build go1.23
+
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import "net/http"
+
+// requestPattern returns the pattern with which an http.ServeMux matched the
+// request.
+func requestPattern(r *http.Request) string {
+	return r.Pattern
+}
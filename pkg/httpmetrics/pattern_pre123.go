@@ -0,0 +1,16 @@
+//go:build !go1.23
+
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import "net/http"
+
+// requestPattern returns "", since http.Request.Pattern is new in Go 1.23.
+// Use SetRoute instead.
+func requestPattern(*http.Request) string {
+	return ""
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CloudTraceContextHeader is the header Google Cloud load balancers and
+// services use to propagate trace context.
+// See https://cloud.google.com/trace/docs/trace-context#legacy-http-header
+const CloudTraceContextHeader = "X-Cloud-Trace-Context"
+
+// CloudTraceContext is a propagation.TextMapPropagator for the
+// X-Cloud-Trace-Context header, which is of the form:
+//
+//	TRACE_ID/SPAN_ID;o=OPTIONS
+//
+// where TRACE_ID is 32 hex characters, SPAN_ID is the decimal representation
+// of the (unsigned) span ID, and OPTIONS is 1 if the trace is sampled.
+type CloudTraceContext struct{}
+
+var _ propagation.TextMapPropagator = CloudTraceContext{}
+
+// Inject implements propagation.TextMapPropagator
+func (CloudTraceContext) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	sid := sc.SpanID()
+	sampled := 0
+	if sc.IsSampled() {
+		sampled = 1
+	}
+	carrier.Set(CloudTraceContextHeader, fmt.Sprintf("%s/%d;o=%d", sc.TraceID(), binary.BigEndian.Uint64(sid[:]), sampled))
+}
+
+// Extract implements propagation.TextMapPropagator
+func (CloudTraceContext) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	sc, ok := parseCloudTraceContext(carrier.Get(CloudTraceContextHeader))
+	if !ok {
+		return ctx
+	}
+	return trace.ContextWithRemoteSpanContext(ctx, sc)
+}
+
+// Fields implements propagation.TextMapPropagator
+func (CloudTraceContext) Fields() []string {
+	return []string{CloudTraceContextHeader}
+}
+
+func parseCloudTraceContext(h string) (trace.SpanContext, bool) {
+	tid, rest, ok := strings.Cut(h, "/")
+	if !ok {
+		return trace.SpanContext{}, false
+	}
+	traceID, err := trace.TraceIDFromHex(tid)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+	sid, opts, _ := strings.Cut(rest, ";")
+	n, err := strconv.ParseUint(sid, 10, 64)
+	if err != nil || n == 0 {
+		return trace.SpanContext{}, false
+	}
+	var spanID trace.SpanID
+	binary.BigEndian.PutUint64(spanID[:], n)
+
+	var flags trace.TraceFlags
+	if opts == "o=1" {
+		flags = trace.FlagsSampled
+	}
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: flags,
+		Remote:     true,
+	})
+	return sc, sc.IsValid()
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestCloudTraceContext(t *testing.T) {
+	for _, c := range []struct {
+		header      string
+		wantValid   bool
+		wantTraceID string
+		wantSpanID  string
+		wantSampled bool
+	}{
+		{"105445aa7843bc8bf206b12000100000/1;o=1", true, "105445aa7843bc8bf206b12000100000", "0000000000000001", true},
+		{"105445aa7843bc8bf206b12000100000/18446744073709551615;o=0", true, "105445aa7843bc8bf206b12000100000", "ffffffffffffffff", false},
+		{"105445aa7843bc8bf206b12000100000/2048", true, "105445aa7843bc8bf206b12000100000", "0000000000000800", false},
+		{"", false, "", "", false},
+		{"105445aa7843bc8bf206b12000100000", false, "", "", false},
+		{"105445aa7843bc8bf206b12000100000/0;o=1", false, "", "", false},
+		{"105445aa7843bc8bf206b12000100000/abc;o=1", false, "", "", false},
+		{"00000000000000000000000000000000/1;o=1", false, "", "", false},
+		{"not-hex/1;o=1", false, "", "", false},
+	} {
+		t.Run(c.header, func(t *testing.T) {
+			h := http.Header{}
+			h.Set(CloudTraceContextHeader, c.header)
+			sc := trace.SpanContextFromContext(CloudTraceContext{}.Extract(context.Background(), propagation.HeaderCarrier(h)))
+			if sc.IsValid() != c.wantValid {
+				t.Fatalf("IsValid() = %t, want %t", sc.IsValid(), c.wantValid)
+			}
+			if !c.wantValid {
+				return
+			}
+			if got := sc.TraceID().String(); got != c.wantTraceID {
+				t.Errorf("TraceID() = %s, want %s", got, c.wantTraceID)
+			}
+			if got := sc.SpanID().String(); got != c.wantSpanID {
+				t.Errorf("SpanID() = %s, want %s", got, c.wantSpanID)
+			}
+			if sc.IsSampled() != c.wantSampled {
+				t.Errorf("IsSampled() = %t, want %t", sc.IsSampled(), c.wantSampled)
+			}
+			if !sc.IsRemote() {
+				t.Error("IsRemote() = false, want true")
+			}
+
+			// Injecting the extracted context round trips.
+			out := http.Header{}
+			CloudTraceContext{}.Inject(trace.ContextWithSpanContext(context.Background(), sc), propagation.HeaderCarrier(out))
+			back := trace.SpanContextFromContext(CloudTraceContext{}.Extract(context.Background(), propagation.HeaderCarrier(out)))
+			if !back.Equal(sc) {
+				t.Errorf("round trip = %v, want %v", back, sc)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// RateLimit is a quota reported by the headers of a response.
+type RateLimit struct {
+	// Resource distinguishes the quotas of one host, e.g. GitHub's "core"
+	// and "search". It is empty for hosts with a single quota.
+	Resource string
+
+	Limit     float64
+	Remaining float64
+
+	// Reset is when the quota resets, or zero if it isn't known.
+	Reset time.Time
+}
+
+// RateLimitExtractor returns the rate limits reported by a response, if any.
+type RateLimitExtractor func(resp *http.Response) []RateLimit
+
+type namedExtractor struct {
+	name    string
+	extract RateLimitExtractor
+}
+
+// builtinExtractors are consulted after the registered ones. The Docker Hub
+// headers are a variant of the IETF ones, so they are tried first.
+var builtinExtractors = []namedExtractor{
+	{"github", GitHubRateLimits},
+	{"dockerhub", DockerHubRateLimits},
+	{"ietf", IETFRateLimits},
+}
+
+// RegisterRateLimitExtractor registers an extractor for the rate limit
+// headers of an API, replacing any extractor registered under the same name.
+// The extractors are consulted most recently registered first, and then the
+// built-in "github", "dockerhub" and "ietf" extractors, until one of them
+// finds rate limits in a response.
+func RegisterRateLimitExtractor(name string, e RateLimitExtractor) {
+	defaultMetrics.RegisterRateLimitExtractor(name, e)
+}
+
+// RegisterRateLimitExtractor registers an extractor for the rate limit
+// headers of an API. See the package-level RegisterRateLimitExtractor.
+func (m *Metrics) RegisterRateLimitExtractor(name string, e RateLimitExtractor) {
+	m.rateLimitMu.Lock()
+	defer m.rateLimitMu.Unlock()
+	extractors := slices.DeleteFunc(slices.Clone(m.rateLimitExtractors), func(ne namedExtractor) bool {
+		return ne.name == name
+	})
+	m.rateLimitExtractors = append([]namedExtractor{{name, e}}, extractors...)
+}
+
+// extractRateLimits returns the rate limits in the response, and the name of
+// the extractor that found them.
+func (m *Metrics) extractRateLimits(resp *http.Response) (string, []RateLimit) {
+	m.rateLimitMu.RLock()
+	extractors := m.rateLimitExtractors
+	m.rateLimitMu.RUnlock()
+	for _, ne := range extractors {
+		if rls := ne.extract(resp); len(rls) > 0 {
+			return ne.name, rls
+		}
+	}
+	for _, ne := range builtinExtractors {
+		if rls := ne.extract(resp); len(rls) > 0 {
+			return ne.name, rls
+		}
+	}
+	return "", nil
+}
+
+func (m *Metrics) newRateLimitCollectors() {
+	labels := []string{"host", "source", "resource", "service_name", "configuration_name", "revision_name"}
+	m.mRateLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "http_client_rate_limit_limit",
+			Help: "The quota of requests in the rate limit window, as reported by the host",
+		},
+		labels,
+	)
+	m.mRateLimitRemaining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "http_client_rate_limit_remaining",
+			Help: "The number of requests remaining in the rate limit window, as reported by the host",
+		},
+		labels,
+	)
+	m.mRateLimitTimeToReset = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "http_client_rate_limit_time_to_reset_seconds",
+			Help: "The number of seconds until the rate limit window resets, as reported by the host",
+		},
+		labels,
+	)
+}
+
+func (m *Metrics) instrumentRateLimits(b *HostBucketer, next http.RoundTripper) promhttp.RoundTripperFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		resp, err := next.RoundTrip(r)
+		if err != nil {
+			return resp, err
+		}
+		source, rls := m.extractRateLimits(resp)
+		if len(rls) == 0 {
+			return resp, err
+		}
+		host := b.Bucket(r.URL.Host)
+		for _, rl := range rls {
+			labels := prometheus.Labels{
+				"host":               host,
+				"source":             source,
+				"resource":           rl.Resource,
+				"service_name":       env.KnativeServiceName,
+				"configuration_name": env.KnativeConfigurationName,
+				"revision_name":      env.KnativeRevisionName,
+			}
+			m.mRateLimit.With(labels).Set(rl.Limit)
+			m.mRateLimitRemaining.With(labels).Set(rl.Remaining)
+			if !rl.Reset.IsZero() {
+				m.mRateLimitTimeToReset.With(labels).Set(max(time.Until(rl.Reset).Seconds(), 0))
+			}
+		}
+		return resp, err
+	}
+}
+
+// GitHubRateLimits extracts the X-RateLimit-* headers sent by GitHub (and
+// others), whose reset is a Unix timestamp.
+// See https://docs.github.com/en/rest/using-the-rest-api/rate-limits-for-the-rest-api
+func GitHubRateLimits(resp *http.Response) []RateLimit {
+	limit, err := strconv.ParseFloat(resp.Header.Get("X-RateLimit-Limit"), 64)
+	if err != nil {
+		return nil
+	}
+	remaining, err := strconv.ParseFloat(resp.Header.Get("X-RateLimit-Remaining"), 64)
+	if err != nil {
+		return nil
+	}
+	rl := RateLimit{
+		Resource:  resp.Header.Get("X-RateLimit-Resource"),
+		Limit:     limit,
+		Remaining: remaining,
+	}
+	if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		rl.Reset = time.Unix(reset, 0)
+	}
+	return []RateLimit{rl}
+}
+
+// IETFRateLimits extracts the RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers of draft-ietf-httpapi-ratelimit-headers, or the
+// RateLimit (and RateLimit-Policy) headers of its later revisions. The reset
+// is in seconds.
+// See https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/
+func IETFRateLimits(resp *http.Response) []RateLimit {
+	limit := firstItem(resp.Header.Get("RateLimit-Limit"))
+	remaining := firstItem(resp.Header.Get("RateLimit-Remaining"))
+	reset := firstItem(resp.Header.Get("RateLimit-Reset"))
+	if v := resp.Header.Get("RateLimit"); v != "" {
+		// e.g. "limit=100, remaining=50, reset=30" or "default";r=50;t=30
+		p := params(v)
+		limit, remaining, reset = p["limit"], p["remaining"], p["reset"]
+		if remaining == "" {
+			remaining, reset = p["r"], p["t"]
+		}
+		if limit == "" {
+			// e.g. "default";q=100;w=60
+			limit = params(resp.Header.Get("RateLimit-Policy"))["q"]
+		}
+	}
+	l, err := strconv.ParseFloat(limit, 64)
+	if err != nil {
+		return nil
+	}
+	r, err := strconv.ParseFloat(remaining, 64)
+	if err != nil {
+		return nil
+	}
+	rl := RateLimit{Limit: l, Remaining: r}
+	if s, err := strconv.ParseInt(reset, 10, 64); err == nil {
+		rl.Reset = time.Now().Add(time.Duration(s) * time.Second)
+	}
+	return []RateLimit{rl}
+}
+
+// DockerHubRateLimits extracts the pull rate limits of Docker Hub, which are
+// sent as RateLimit-Limit and RateLimit-Remaining with the window, e.g.
+// "100;w=21600", alongside Docker-RateLimit-Source. The window is rolling,
+// so there is no reset.
+// See https://docs.docker.com/docker-hub/download-rate-limit/
+func DockerHubRateLimits(resp *http.Response) []RateLimit {
+	if resp.Header.Get("Docker-RateLimit-Source") == "" {
+		return nil
+	}
+	limit, err := strconv.ParseFloat(firstItem(resp.Header.Get("RateLimit-Limit")), 64)
+	if err != nil {
+		return nil
+	}
+	remaining, err := strconv.ParseFloat(firstItem(resp.Header.Get("RateLimit-Remaining")), 64)
+	if err != nil {
+		return nil
+	}
+	return []RateLimit{{Resource: "pull", Limit: limit, Remaining: remaining}}
+}
+
+// params returns the key=value pairs in the items and parameters of a
+// structured field, keeping the first value of each key.
+func params(v string) map[string]string {
+	p := map[string]string{}
+	for _, item := range strings.Split(v, ",") {
+		for _, kv := range strings.Split(item, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+			if _, seen := p[k]; ok && !seen {
+				p[k] = v
+			}
+		}
+	}
+	return p
+}
+
+// firstItem returns the value of the first item of a structured field list,
+// without its parameters, e.g. "100" from "100;w=60, 1000;w=3600".
+func firstItem(v string) string {
+	v, _, _ = strings.Cut(v, ",")
+	v, _, _ = strings.Cut(v, ";")
+	return strings.TrimSpace(v)
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRateLimitExtractors(t *testing.T) {
+	now := time.Now()
+	for _, c := range []struct {
+		name       string
+		headers    map[string]string
+		wantSource string
+		want       []RateLimit
+	}{{
+		name:    "none",
+		headers: map[string]string{"Content-Type": "text/plain"},
+	}, {
+		name: "github",
+		headers: map[string]string{
+			"X-RateLimit-Limit":     "5000",
+			"X-RateLimit-Remaining": "4999",
+			"X-RateLimit-Reset":     "1700000000",
+			"X-RateLimit-Resource":  "core",
+		},
+		wantSource: "github",
+		want:       []RateLimit{{Resource: "core", Limit: 5000, Remaining: 4999, Reset: time.Unix(1700000000, 0)}},
+	}, {
+		name: "docker hub",
+		headers: map[string]string{
+			"RateLimit-Limit":         "100;w=21600",
+			"RateLimit-Remaining":     "76;w=21600",
+			"Docker-RateLimit-Source": "1.2.3.4",
+		},
+		wantSource: "dockerhub",
+		want:       []RateLimit{{Resource: "pull", Limit: 100, Remaining: 76}},
+	}, {
+		name: "ietf",
+		headers: map[string]string{
+			"RateLimit-Limit":     "100, 100;w=60",
+			"RateLimit-Remaining": "50",
+			"RateLimit-Reset":     "30",
+		},
+		wantSource: "ietf",
+		want:       []RateLimit{{Limit: 100, Remaining: 50, Reset: now.Add(30 * time.Second)}},
+	}, {
+		name: "ietf dictionary",
+		headers: map[string]string{
+			"RateLimit": "limit=10, remaining=5, reset=60",
+		},
+		wantSource: "ietf",
+		want:       []RateLimit{{Limit: 10, Remaining: 5, Reset: now.Add(time.Minute)}},
+	}, {
+		name: "ietf policy",
+		headers: map[string]string{
+			"RateLimit":        `"default";r=7;t=10`,
+			"RateLimit-Policy": `"default";q=20;w=60`,
+		},
+		wantSource: "ietf",
+		want:       []RateLimit{{Limit: 20, Remaining: 7, Reset: now.Add(10 * time.Second)}},
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			m := newMetrics(prometheus.NewRegistry(), metricsConfig{})
+			resp := &http.Response{Header: http.Header{}}
+			for k, v := range c.headers {
+				resp.Header.Set(k, v)
+			}
+			source, got := m.extractRateLimits(resp)
+			if source != c.wantSource {
+				t.Errorf("source = %q, want %q", source, c.wantSource)
+			}
+			if diff := cmp.Diff(c.want, got, cmpopts.EquateApproxTime(time.Second)); diff != "" {
+				t.Errorf("rate limits (-want +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestRegisterRateLimitExtractor(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := NewMetrics(reg)
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	// Registered extractors take precedence over the built-in ones.
+	m.RegisterRateLimitExtractor("custom", func(resp *http.Response) []RateLimit {
+		if resp.Header.Get("X-Quota") == "" {
+			return nil
+		}
+		return []RateLimit{{Resource: "quota", Limit: 10, Remaining: 1}}
+	})
+	b, err := NewHostBucketer([]HostBucketRule{{Kind: RuleExact, Pattern: "api.example.com", Bucket: "example"}})
+	if err != nil {
+		t.Fatalf("NewHostBucketer() = %v", err)
+	}
+	var calls int
+	client := &http.Client{Transport: m.WrapTransport(fakeGitHub(&calls, http.StatusOK, map[string]string{
+		"X-Quota":             "yes",
+		"RateLimit-Limit":     "100",
+		"RateLimit-Remaining": "50",
+	}), WithHostBucketer(b))}
+	resp, err := client.Get("https://api.example.com/")
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	resp.Body.Close()
+
+	if got := testutil.ToFloat64(m.mRateLimitRemaining.With(prometheus.Labels{
+		"host":               "example",
+		"source":             "custom",
+		"resource":           "quota",
+		"service_name":       env.KnativeServiceName,
+		"configuration_name": env.KnativeConfigurationName,
+		"revision_name":      env.KnativeRevisionName,
+	})); got != 1 {
+		t.Errorf("http_client_rate_limit_remaining = %v, want 1", got)
+	}
+	if got := testutil.CollectAndCount(m.mRateLimitRemaining); got != 1 {
+		t.Errorf("http_client_rate_limit_remaining series = %d, want 1", got)
+	}
+}
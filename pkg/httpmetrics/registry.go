@@ -0,0 +1,262 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics holds the collectors behind the instrumentation of this package,
+// registered with a single prometheus.Registerer. Its methods mirror the
+// package-level functions, which use a default instance registered with
+// prometheus.DefaultRegisterer.
+type Metrics struct {
+	reg      prometheus.Registerer
+	gatherer prometheus.Gatherer
+
+	// Server metrics, see Handler.
+	inFlightGauge *prometheus.GaugeVec
+	counter       *prometheus.CounterVec
+
+	// Load shedding metrics, see WithLoadShedding.
+	mShed             *prometheus.CounterVec
+	mConcurrencyLimit *prometheus.GaugeVec
+
+	// Panic metrics, see Handler.
+	mPanics *prometheus.CounterVec
+
+	// Client metrics, see WrapTransport.
+	mReqCount    *prometheus.CounterVec
+	mReqInFlight *prometheus.GaugeVec
+
+	// Body size metrics, see instrumentRoundTripperSize.
+	mReqBytes  *prometheus.CounterVec
+	mRespBytes *prometheus.CounterVec
+
+	// Connection metrics, see WithConnectionTrace.
+	mReqConns *prometheus.CounterVec
+
+	// Retry metrics, see WithRetries.
+	mReqRetries          *prometheus.CounterVec
+	mReqRetriesExhausted *prometheus.CounterVec
+
+	// GitHub rate limit metrics.
+	mGitHubRateLimitRemaining   *prometheus.GaugeVec
+	mGitHubRateLimit            *prometheus.GaugeVec
+	mGitHubRateLimitReset       *prometheus.GaugeVec
+	mGitHubRateLimitUsed        *prometheus.GaugeVec
+	mGitHubRateLimitTimeToReset *prometheus.GaugeVec
+	mGitHubGraphQLPoints        *prometheus.CounterVec
+	graphqlUsage                graphqlUsage
+
+	// GitHub rate limit metrics by identity, see
+	// WithGitHubRateLimitsByIdentity.
+	mGitHubIdentityRemaining     *prometheus.GaugeVec
+	mGitHubIdentityLimit         *prometheus.GaugeVec
+	mGitHubIdentityUsed          *prometheus.GaugeVec
+	mGitHubIdentityReset         *prometheus.GaugeVec
+	mGitHubIdentityGraphQLPoints *prometheus.CounterVec
+	githubIdentities             githubIdentities
+
+	// Rate limit metrics, see RegisterRateLimitExtractor.
+	mRateLimit            *prometheus.GaugeVec
+	mRateLimitRemaining   *prometheus.GaugeVec
+	mRateLimitTimeToReset *prometheus.GaugeVec
+	rateLimitMu           sync.RWMutex
+	rateLimitExtractors   []namedExtractor
+
+	// GitHub throttling metrics, see WithGitHubThrottling.
+	mGitHubThrottleWait *prometheus.CounterVec
+	mGitHubThrottled    *prometheus.CounterVec
+
+	// gRPC metrics, see ServerOptions and DialOptions.
+	grpcServerHandled  *prometheus.CounterVec
+	grpcServerInFlight *prometheus.GaugeVec
+	grpcClientHandled  *prometheus.CounterVec
+	grpcClientInFlight *prometheus.GaugeVec
+
+	// The task of a Cloud Run job, see loadLabelEnv.
+	jobTaskInfo *prometheus.GaugeVec
+
+	// The checks behind /readyz, see AddReadinessCheck.
+	readinessMu sync.RWMutex
+	readiness   map[string]ReadinessCheck
+
+	// The histograms are created by initHistograms, see ConfigureHistograms.
+	histogramsMu      sync.Mutex
+	histogramsCreated bool
+	histogramsOnce    sync.Once
+	histogramsErr     error
+	histograms        histogramConfig
+	duration          *prometheus.HistogramVec
+	responseSize      *prometheus.HistogramVec
+	mReqDuration      *prometheus.HistogramVec
+	mReqSize          *prometheus.HistogramVec
+	mRespSize         *prometheus.HistogramVec
+	mReqDNS           *prometheus.HistogramVec
+	mReqConnect       *prometheus.HistogramVec
+	mReqTLS           *prometheus.HistogramVec
+	mReqTTFB          *prometheus.HistogramVec
+	deliveryLatency   *prometheus.HistogramVec
+	deliveryAttempts  *prometheus.HistogramVec
+
+	grpcServerHandling *prometheus.HistogramVec
+	grpcClientHandling *prometheus.HistogramVec
+}
+
+// MetricsOption configures a Metrics.
+type MetricsOption func(*metricsConfig)
+
+type metricsConfig struct {
+	gatherer    prometheus.Gatherer
+	constLabels prometheus.Labels
+	histograms  []HistogramOption
+}
+
+// WithGatherer sets the gatherer from which ServeMetrics and SetupMeter
+// read the metrics. It defaults to the registerer passed to NewMetrics, if
+// it is also a prometheus.Gatherer (e.g. a *prometheus.Registry).
+func WithGatherer(g prometheus.Gatherer) MetricsOption {
+	return func(c *metricsConfig) { c.gatherer = g }
+}
+
+// WithConstLabels adds the labels to all of the metrics, e.g. to tell apart
+// two instrumented components in one process.
+func WithConstLabels(labels prometheus.Labels) MetricsOption {
+	return func(c *metricsConfig) { c.constLabels = labels }
+}
+
+// WithHistograms sets the bucket layouts of the histograms, as
+// ConfigureHistograms does for the default instance.
+func WithHistograms(opts ...HistogramOption) MetricsOption {
+	return func(c *metricsConfig) { c.histograms = append(c.histograms, opts...) }
+}
+
+// NewMetrics creates the collectors of this package and registers them
+// with reg. It returns an error if they are already registered, e.g. when
+// two Metrics share a registry without distinct WithConstLabels (which all
+// of the Metrics sharing a registry must then use).
+func NewMetrics(reg prometheus.Registerer, opts ...MetricsOption) (*Metrics, error) {
+	var cfg metricsConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	m := newMetrics(reg, cfg)
+	for _, opt := range cfg.histograms {
+		opt(&m.histograms)
+	}
+	if err := m.histograms.validate(); err != nil {
+		return nil, err
+	}
+	if err := m.register(m.collectors()...); err != nil {
+		return nil, err
+	}
+	// Unlike the default instance, the histograms are configured up front.
+	if err := m.initHistograms(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func newMetrics(reg prometheus.Registerer, cfg metricsConfig) *Metrics {
+	gatherer := cfg.gatherer
+	if g, ok := reg.(prometheus.Gatherer); ok && gatherer == nil {
+		gatherer = g
+	}
+	if len(cfg.constLabels) > 0 {
+		reg = prometheus.WrapRegistererWith(cfg.constLabels, reg)
+	}
+	m := &Metrics{
+		reg:       reg,
+		gatherer:  gatherer,
+		readiness: map[string]ReadinessCheck{},
+		graphqlUsage: graphqlUsage{
+			state: map[githubKey]graphqlWindow{},
+		},
+		githubIdentities: githubIdentities{
+			issued: map[string]struct{}{},
+		},
+		histograms: histogramConfig{
+			ServerDuration:  DefaultDurationBuckets,
+			ResponseSize:    DefaultResponseSizeBuckets,
+			ClientDuration:  DefaultDurationBuckets,
+			ClientSize:      DefaultClientSizeBuckets,
+			ClientPhase:     DefaultClientPhaseBuckets,
+			DeliveryLatency: DefaultDeliveryLatencyBuckets,
+		},
+	}
+	m.newServerCollectors()
+	m.newSheddingCollectors()
+	m.newPanicCollectors()
+	m.newClientCollectors()
+	m.newSizeCollectors()
+	m.newTraceCollectors()
+	m.newRetryCollectors()
+	m.newGitHubCollectors()
+	m.newGitHubThrottleCollectors()
+	m.newRateLimitCollectors()
+	m.newGRPCCollectors()
+	m.newJobCollectors()
+	return m
+}
+
+// collectors returns all of the collectors, except for the histograms.
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.inFlightGauge,
+		m.counter,
+		m.mShed,
+		m.mConcurrencyLimit,
+		m.mPanics,
+		m.mReqCount,
+		m.mReqInFlight,
+		m.mReqBytes,
+		m.mRespBytes,
+		m.mReqConns,
+		m.mReqRetries,
+		m.mReqRetriesExhausted,
+		m.mGitHubRateLimitRemaining,
+		m.mGitHubRateLimit,
+		m.mGitHubRateLimitReset,
+		m.mGitHubRateLimitUsed,
+		m.mGitHubRateLimitTimeToReset,
+		m.mGitHubGraphQLPoints,
+		m.mGitHubIdentityRemaining,
+		m.mGitHubIdentityLimit,
+		m.mGitHubIdentityUsed,
+		m.mGitHubIdentityReset,
+		m.mGitHubIdentityGraphQLPoints,
+		m.mGitHubThrottleWait,
+		m.mGitHubThrottled,
+		m.mRateLimit,
+		m.mRateLimitRemaining,
+		m.mRateLimitTimeToReset,
+		m.grpcServerHandled,
+		m.grpcServerInFlight,
+		m.grpcClientHandled,
+		m.grpcClientInFlight,
+		m.jobTaskInfo,
+	}
+}
+
+func (m *Metrics) register(cs ...prometheus.Collector) error {
+	for _, c := range cs {
+		if err := m.reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultMetrics backs the package-level functions. Its histograms are
+// created on first use, so that ConfigureHistograms can change them.
+var defaultMetrics = func() *Metrics {
+	m := newMetrics(prometheus.DefaultRegisterer, metricsConfig{gatherer: prometheus.DefaultGatherer})
+	prometheus.MustRegister(m.collectors()...)
+	return m
+}()
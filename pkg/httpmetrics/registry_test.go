@@ -0,0 +1,69 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNewMetricsSharedRegistry(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	a, err := NewMetrics(reg, WithConstLabels(prometheus.Labels{"component": "a"}))
+	if err != nil {
+		t.Fatalf("NewMetrics(a) = %v", err)
+	}
+	b, err := NewMetrics(reg, WithConstLabels(prometheus.Labels{"component": "b"}))
+	if err != nil {
+		t.Fatalf("NewMetrics(b) = %v", err)
+	}
+	// The same label set can't be registered twice.
+	if _, err := NewMetrics(reg, WithConstLabels(prometheus.Labels{"component": "a"})); err == nil {
+		t.Error("NewMetrics(a) = nil, wanted error")
+	}
+
+	for _, m := range []*Metrics{a, b, a} {
+		rec := httptest.NewRecorder()
+		m.Handler("shared", http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	if got, want := testutil.ToFloat64(a.counter), 2.0; got != want {
+		t.Errorf("component a count = %f, want %f", got, want)
+	}
+	if got, want := testutil.ToFloat64(b.counter), 1.0; got != want {
+		t.Errorf("component b count = %f, want %f", got, want)
+	}
+	if n, err := testutil.GatherAndCount(reg, "http_request_status"); err != nil {
+		t.Errorf("GatherAndCount() = %v", err)
+	} else if n != 2 {
+		t.Errorf("http_request_status series = %d, want 2", n)
+	}
+}
+
+func TestDefaultMetrics(t *testing.T) {
+	// The package-level functions register with the default registry.
+	defaultMetrics.mustInitHistograms()
+	for _, name := range []string{
+		"http_inflight_requests",
+		"http_request_status",
+		"http_request_duration_seconds",
+		"http_response_size_bytes",
+		"http_client_request_count",
+		"http_client_request_in_flight",
+		"http_client_request_duration_seconds",
+		"http_client_request_bytes_total",
+		"http_client_response_size_bytes",
+		"github_rate_limit",
+	} {
+		if err := prometheus.DefaultRegisterer.Register(prometheus.NewGauge(prometheus.GaugeOpts{Name: name})); err == nil {
+			t.Errorf("%s is not registered with the default registry", name)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path"
+	"strconv"
+
+	"cloud.google.com/go/compute/metadata"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// gcpCloudRunConfigurationKey has no semantic convention, so we follow the
+// naming of the gcp.cloud_run.job.* attributes.
+const gcpCloudRunConfigurationKey = attribute.Key("gcp.cloud_run.configuration")
+
+// newResource describes this process to OpenTelemetry as a Cloud Run
+// service or job, based on the environment variables from the container
+// contract (as read by loadLabelEnv) and, when available, the project and
+// region from the metadata server. Locally (or in tests), GCE_METADATA_HOST
+// can point at a stand-in for the metadata server.
+//
+// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence over what
+// is detected here.
+func newResource(ctx context.Context) (*resource.Resource, error) {
+	run := env.CloudRun
+	var attrs []attribute.KeyValue
+	switch {
+	case run.Service != "":
+		attrs = append(attrs,
+			semconv.CloudProviderGCP,
+			semconv.CloudPlatformGCPCloudRun,
+			semconv.ServiceName(run.Service),
+			semconv.FaaSName(run.Service),
+		)
+		if run.Revision != "" {
+			attrs = append(attrs,
+				semconv.ServiceVersion(run.Revision),
+				semconv.FaaSVersion(run.Revision),
+			)
+		}
+		if run.Configuration != "" {
+			attrs = append(attrs, gcpCloudRunConfigurationKey.String(run.Configuration))
+		}
+
+	case run.Job != "":
+		attrs = append(attrs,
+			semconv.CloudProviderGCP,
+			semconv.CloudPlatformGCPCloudRun,
+			semconv.ServiceName(run.Job),
+			semconv.FaaSName(run.Job),
+		)
+		if run.Execution != "" {
+			attrs = append(attrs, semconv.GCPCloudRunJobExecution(run.Execution))
+		}
+		if i, err := strconv.Atoi(run.TaskIndex); err == nil {
+			attrs = append(attrs, semconv.GCPCloudRunJobTaskIndex(i))
+		}
+		if i, err := strconv.Atoi(run.TaskAttempt); err == nil {
+			attrs = append(attrs, attribute.Int("gcp.cloud_run.job.task_attempt", i))
+		}
+	}
+
+	// metadata.OnGCE caches its answer, so check for a stand-in first.
+	if os.Getenv("GCE_METADATA_HOST") != "" || metadata.OnGCE() {
+		if project, err := metadata.ProjectID(); err != nil {
+			slog.WarnContext(ctx, "Failed to get project ID from the metadata server", "error", err)
+		} else {
+			attrs = append(attrs, semconv.CloudAccountID(project))
+		}
+		// This is of the form projects/<number>/regions/<region>.
+		if region, err := metadata.Get("instance/region"); err != nil {
+			slog.WarnContext(ctx, "Failed to get region from the metadata server", "error", err)
+		} else {
+			attrs = append(attrs, semconv.CloudRegion(path.Base(region)))
+		}
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, attrs...))
+	if err != nil {
+		return nil, err
+	}
+	return resource.Merge(res, resource.Environment())
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewResource(t *testing.T) {
+	// A stand-in for the metadata server.
+	mds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			t.Errorf("missing Metadata-Flavor header")
+		}
+		switch r.URL.Path {
+		case "/computeMetadata/v1/project/project-id":
+			w.Write([]byte("my-project"))
+		case "/computeMetadata/v1/instance/region":
+			w.Write([]byte("projects/1234/regions/us-east4"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mds.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(mds.URL, "http://"))
+
+	prev := env
+	defer func() { env = prev }()
+
+	for _, c := range []struct {
+		name string
+		env  map[string]string
+		want map[string]string
+	}{{
+		name: "service",
+		env: map[string]string{
+			"K_SERVICE":       "my-service",
+			"K_REVISION":      "my-service-00001-abc",
+			"K_CONFIGURATION": "my-service",
+		},
+		want: map[string]string{
+			"cloud.provider":              "gcp",
+			"cloud.platform":              "gcp_cloud_run",
+			"cloud.account.id":            "my-project",
+			"cloud.region":                "us-east4",
+			"service.name":                "my-service",
+			"service.version":             "my-service-00001-abc",
+			"faas.name":                   "my-service",
+			"faas.version":                "my-service-00001-abc",
+			"gcp.cloud_run.configuration": "my-service",
+		},
+	}, {
+		name: "job",
+		env: map[string]string{
+			"CLOUD_RUN_JOB":          "my-job",
+			"CLOUD_RUN_EXECUTION":    "my-job-xyz",
+			"CLOUD_RUN_TASK_INDEX":   "3",
+			"CLOUD_RUN_TASK_ATTEMPT": "1",
+		},
+		want: map[string]string{
+			"cloud.provider":                 "gcp",
+			"cloud.platform":                 "gcp_cloud_run",
+			"cloud.account.id":               "my-project",
+			"cloud.region":                   "us-east4",
+			"service.name":                   "my-job",
+			"faas.name":                      "my-job",
+			"gcp.cloud_run.job.execution":    "my-job-xyz",
+			"gcp.cloud_run.job.task_index":   "3",
+			"gcp.cloud_run.job.task_attempt": "1",
+		},
+	}, {
+		name: "env takes precedence",
+		env: map[string]string{
+			"K_SERVICE":         "my-service",
+			"OTEL_SERVICE_NAME": "override",
+		},
+		want: map[string]string{
+			"cloud.provider":   "gcp",
+			"cloud.platform":   "gcp_cloud_run",
+			"cloud.account.id": "my-project",
+			"cloud.region":     "us-east4",
+			"service.name":     "override",
+			"faas.name":        "my-service",
+		},
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			for k, v := range c.env {
+				t.Setenv(k, v)
+			}
+			env = loadLabelEnv()
+			res, err := newResource(context.Background())
+			if err != nil {
+				t.Fatalf("newResource() = %v", err)
+			}
+			got := map[string]string{}
+			for _, kv := range res.Attributes() {
+				// Skip the attributes of resource.Default()
+				if strings.HasPrefix(string(kv.Key), "telemetry.sdk.") {
+					continue
+				}
+				got[string(kv.Key)] = kv.Value.Emit()
+			}
+			if diff := cmp.Diff(c.want, got); diff != "" {
+				t.Errorf("newResource() (-want +got): %s", diff)
+			}
+		})
+	}
+}
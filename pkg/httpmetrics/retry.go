@@ -0,0 +1,252 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultRetryStatusCodes are the response codes retried by WithRetries
+// unless configured otherwise.
+var DefaultRetryStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// CloudEventsRetryStatusCodes are the response codes on which the
+// CloudEvents SDK retries deliveries, see WithCloudEventsRetries.
+var CloudEventsRetryStatusCodes = []int{
+	http.StatusNotFound,
+	http.StatusRequestEntityTooLarge,
+	http.StatusTooEarly,
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// RetryOption configures the retries added by WithRetries.
+type RetryOption func(*retryConfig)
+
+type retryConfig struct {
+	maxRetries  int
+	initial     time.Duration
+	max         time.Duration
+	statusCodes []int
+}
+
+// WithMaxRetries sets the number of retries after the first attempt.
+// The default is 3.
+func WithMaxRetries(n int) RetryOption {
+	return func(c *retryConfig) { c.maxRetries = n }
+}
+
+// WithRetryBackoff sets the bounds of the exponential backoff between
+// attempts. The default is 100ms, doubling up to 10s.
+func WithRetryBackoff(initial, max time.Duration) RetryOption {
+	return func(c *retryConfig) { c.initial, c.max = initial, max }
+}
+
+// WithRetryStatusCodes sets the response codes to retry, replacing
+// DefaultRetryStatusCodes.
+func WithRetryStatusCodes(codes ...int) RetryOption {
+	return func(c *retryConfig) { c.statusCodes = codes }
+}
+
+// WithRetries makes WrapTransport retry idempotent requests that fail, or
+// whose response has one of the retried status codes, with jittered
+// exponential backoff. A Retry-After header on the response replaces the
+// backoff, unless it exceeds the maximum, in which case the response is
+// returned for the caller to handle. Retries stop once the context's
+// deadline doesn't leave time for the next attempt.
+//
+// Requests are idempotent if their method is, or if they carry an
+// Idempotency-Key or a CloudEvent ID (which receivers deduplicate on).
+// Requests with a body are only retried if it can be replayed with GetBody,
+// as it is by http.NewRequest.
+func WithRetries(opts ...RetryOption) TransportOption {
+	cfg := &retryConfig{
+		maxRetries:  3,
+		initial:     100 * time.Millisecond,
+		max:         10 * time.Second,
+		statusCodes: DefaultRetryStatusCodes,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return func(c *transportConfig) { c.retries = cfg }
+}
+
+// WithCloudEventsRetries is WithRetries on CloudEventsRetryStatusCodes
+// (unless configured otherwise), for the clients of cloudevents.NewClientHTTP
+// in place of the SDK's own retries. Binary mode events are idempotent by
+// their Ce-Id, and the SDK makes their body replayable.
+func WithCloudEventsRetries(opts ...RetryOption) TransportOption {
+	return WithRetries(append([]RetryOption{WithRetryStatusCodes(CloudEventsRetryStatusCodes...)}, opts...)...)
+}
+
+func (m *Metrics) newRetryCollectors() {
+	m.mReqRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_client_request_retries_total",
+			Help: "The number of HTTP requests retried, by the code of the attempt that was retried",
+		},
+		[]string{"code", "method", "host", "service_name", "configuration_name", "revision_name", "ce_type"},
+	)
+	m.mReqRetriesExhausted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_client_request_retries_exhausted_total",
+			Help: "The number of HTTP requests that failed after using up their retries",
+		},
+		[]string{"code", "method", "host", "service_name", "configuration_name", "revision_name", "ce_type"},
+	)
+}
+
+// idempotentMethods are the methods that RFC 9110 defines as idempotent.
+var idempotentMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+	http.MethodTrace,
+	http.MethodPut,
+	http.MethodDelete,
+}
+
+func isIdempotent(r *http.Request) bool {
+	if slices.Contains(idempotentMethods, r.Method) {
+		return true
+	}
+	for _, h := range []string{"Idempotency-Key", "X-Idempotency-Key", "Ce-Id"} {
+		if r.Header.Get(h) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func canReplay(r *http.Request) bool {
+	return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+}
+
+// retryAfter parses the Retry-After header, in seconds or as an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// backoff returns the full-jitter delay before the given retry (from 0).
+func (c *retryConfig) backoff(retry int) time.Duration {
+	d := c.max
+	if retry < 32 {
+		d = min(c.initial<<retry, c.max)
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1)) //nolint:gosec
+}
+
+func (m *Metrics) instrumentRoundTripperRetries(c *retryConfig, b *HostBucketer, next http.RoundTripper) promhttp.RoundTripperFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		if !isIdempotent(r) || !canReplay(r) {
+			return next.RoundTrip(r)
+		}
+		ctx := r.Context()
+		req := r
+		for retry := 0; ; retry++ {
+			resp, err := next.RoundTrip(req)
+
+			var code string
+			switch {
+			case err != nil:
+				// The caller gave up, or we did, so there's no point in retrying.
+				if ctx.Err() != nil || errors.Is(err, ErrGitHubRateLimited) {
+					return nil, err
+				}
+				code = mapErrorToLabel(err)
+			case slices.Contains(c.statusCodes, resp.StatusCode):
+				code = strconv.Itoa(resp.StatusCode)
+			default:
+				return resp, nil
+			}
+			labels := prometheus.Labels{
+				"code":               code,
+				"method":             r.Method,
+				"host":               b.Bucket(r.URL.Host),
+				"service_name":       env.KnativeServiceName,
+				"configuration_name": env.KnativeConfigurationName,
+				"revision_name":      env.KnativeRevisionName,
+				"ce_type":            r.Header.Get(CeTypeHeader),
+			}
+
+			delay := c.backoff(retry)
+			if resp != nil {
+				if d, ok := retryAfter(resp); ok {
+					delay = d
+				}
+			}
+			log := clog.FromContext(ctx).With("method", r.Method, "host", r.URL.Host, "path", r.URL.Path, "code", code, "attempt", retry+1)
+			if retry >= c.maxRetries || delay > c.max || !hasTimeFor(ctx, delay) {
+				m.mReqRetriesExhausted.With(labels).Inc()
+				log.WarnContext(ctx, "Giving up on request after retries")
+				return resp, err
+			}
+			if resp != nil {
+				// Drain the body so that the connection can be reused.
+				_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+				resp.Body.Close()
+			}
+			m.mReqRetries.With(labels).Inc()
+			log.InfoContext(ctx, "Retrying request", "delay", delay)
+
+			t := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return nil, ctx.Err()
+			case <-t.C:
+			}
+
+			req = r.Clone(ctx)
+			if r.GetBody != nil {
+				body, err := r.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req.Body = body
+			}
+		}
+	}
+}
+
+// hasTimeFor reports whether the context's deadline leaves time to wait for
+// the delay, and then to make another attempt.
+func hasTimeFor(ctx context.Context, delay time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) > delay
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// flakyServer fails the first n requests with the status, and echoes the
+// request body once it succeeds.
+func flakyServer(t *testing.T, n int32, status int, retryAfter string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= n {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(status)
+			return
+		}
+		io.Copy(w, r.Body) //nolint:errcheck
+	}))
+	t.Cleanup(s.Close)
+	return s, &calls
+}
+
+func TestRetries(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	client := &http.Client{Transport: m.WrapTransport(http.DefaultTransport,
+		WithRetries(WithRetryBackoff(time.Millisecond, 10*time.Millisecond)))}
+
+	s, calls := flakyServer(t, 2, http.StatusServiceUnavailable, "0")
+	req, _ := http.NewRequest(http.MethodPost, s.URL, strings.NewReader("hello"))
+	req.Header.Set("Ce-Id", "1234")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do() = %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("Do() = %d %q, want 200 %q", resp.StatusCode, body, "hello")
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("calls = %d, want 3", got)
+	}
+	if got := testutil.ToFloat64(m.mReqRetries); got != 2 {
+		t.Errorf("retries = %v, want 2", got)
+	}
+	// Each attempt is counted.
+	if got := testutil.ToFloat64(m.mReqCount.With(prometheus.Labels{
+		"code":               "503",
+		"method":             http.MethodPost,
+		"host":               "other",
+		"service_name":       env.KnativeServiceName,
+		"configuration_name": env.KnativeConfigurationName,
+		"revision_name":      env.KnativeRevisionName,
+		"ce_type":            "",
+		"operation":          "",
+	})); got != 2 {
+		t.Errorf("503 attempts = %v, want 2", got)
+	}
+}
+
+func TestRetriesNotIdempotent(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	client := &http.Client{Transport: m.WrapTransport(http.DefaultTransport, WithRetries())}
+
+	s, calls := flakyServer(t, 1, http.StatusServiceUnavailable, "")
+	resp, err := client.Post(s.URL, "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("Post() = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Errorf("Post() = %d after %d calls, want 503 after 1", resp.StatusCode, calls.Load())
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		retryAfter string
+		timeout    time.Duration
+		wantCalls  int32
+	}{{
+		name:      "max retries",
+		wantCalls: 3,
+	}, {
+		name:       "retry-after beyond max backoff",
+		retryAfter: "60",
+		wantCalls:  1,
+	}, {
+		name:       "retry-after beyond deadline",
+		retryAfter: "1",
+		timeout:    500 * time.Millisecond,
+		wantCalls:  1,
+	}} {
+		t.Run(c.name, func(t *testing.T) {
+			m, err := NewMetrics(prometheus.NewRegistry())
+			if err != nil {
+				t.Fatalf("NewMetrics() = %v", err)
+			}
+			client := &http.Client{Transport: m.WrapTransport(http.DefaultTransport, WithRetries(
+				WithMaxRetries(2),
+				WithRetryBackoff(time.Millisecond, 5*time.Second),
+				WithRetryStatusCodes(http.StatusTooManyRequests),
+			))}
+
+			s, calls := flakyServer(t, 100, http.StatusTooManyRequests, c.retryAfter)
+			ctx := context.Background()
+			if c.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, c.timeout)
+				defer cancel()
+			}
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Do() = %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusTooManyRequests {
+				t.Errorf("Do() = %d, want 429", resp.StatusCode)
+			}
+			if got := calls.Load(); got != c.wantCalls {
+				t.Errorf("calls = %d, want %d", got, c.wantCalls)
+			}
+			if got := testutil.ToFloat64(m.mReqRetriesExhausted); got != 1 {
+				t.Errorf("exhausted = %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for v, want := range map[string]time.Duration{
+		"":        -1,
+		"3":       3 * time.Second,
+		"-1":      -1,
+		"garbage": -1,
+		time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat): 0,
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set("Retry-After", v)
+		got, ok := retryAfter(resp)
+		if !ok {
+			got = -1
+		}
+		if got != want {
+			t.Errorf("retryAfter(%q) = %v, want %v", v, got, want)
+		}
+	}
+}
+
+func TestCloudEventsRetries(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	for _, code := range CloudEventsRetryStatusCodes {
+		t.Run(http.StatusText(code), func(t *testing.T) {
+			var mu sync.Mutex
+			attempts, delivered := 0, map[string]int{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts++
+				if attempts == 1 {
+					w.WriteHeader(code)
+					return
+				}
+				delivered[r.Header.Get("Ce-Id")]++
+			}))
+			defer srv.Close()
+
+			c, err := cloudevents.NewClientHTTP(
+				cloudevents.WithTarget(srv.URL),
+				cehttp.WithClient(http.Client{Transport: m.WrapTransport(http.DefaultTransport,
+					WithCloudEventsRetries(WithRetryBackoff(time.Millisecond, 10*time.Millisecond)))}))
+			if err != nil {
+				t.Fatalf("NewClientHTTP() = %v", err)
+			}
+			event := cloudevents.NewEvent()
+			event.SetID("1234")
+			event.SetType("dev.chainguard.test")
+			event.SetSource("test")
+			if err := event.SetData(cloudevents.ApplicationJSON, map[string]string{"hello": "world"}); err != nil {
+				t.Fatalf("SetData() = %v", err)
+			}
+			if result := c.Send(context.Background(), event); !cloudevents.IsACK(result) {
+				t.Fatalf("Send() = %v", result)
+			}
+
+			// The event is retried, and delivered exactly once.
+			mu.Lock()
+			defer mu.Unlock()
+			if attempts != 2 {
+				t.Errorf("attempts = %d, want 2", attempts)
+			}
+			if len(delivered) != 1 || delivered[event.ID()] != 1 {
+				t.Errorf("delivered = %v, want %s once", delivered, event.ID())
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultMaxRoutes is the default cap on the number of distinct values of
+// the "route" label of each Handler, beyond which routes are labeled "other".
+const DefaultMaxRoutes = 50
+
+// otherRoute is the route of requests beyond the cap of their Handler.
+const otherRoute = "other"
+
+// WithMaxRoutes caps the number of distinct values of the "route" label.
+// The routes come from the patterns of an http.ServeMux, which need
+// httpmuxgo121=0 in binaries whose go.mod predates Go 1.22 (see Handler),
+// or from SetRoute.
+func WithMaxRoutes(n int) HandlerOption {
+	return func(c *handlerConfig) { c.maxRoutes = n }
+}
+
+type routeKey struct{}
+
+// routeHolder carries the route of a request up from the handler that
+// matched it (or called SetRoute) to the instrumentation around it.
+type routeHolder struct {
+	mu       sync.Mutex
+	route    string
+	explicit bool
+
+	// label is the bounded value of the "route" label, set by recordRoute.
+	label string
+}
+
+// setPattern records the ServeMux pattern, unless SetRoute was called.
+func (h *routeHolder) setPattern(pattern string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if pattern != "" && !h.explicit {
+		h.route = pattern
+	}
+}
+
+// SetRoute sets the "route" label of the metrics, and the name of the span,
+// of the request served by Handler, for routers other than http.ServeMux.
+// The route must be a template (e.g. "/users/{id}"), not the request path.
+// It is a no-op outside of Handler. SetRoute doesn't depend on the GODEBUG
+// settings of the ServeMux (see Handler), and takes precedence over its
+// pattern.
+func SetRoute(ctx context.Context, route string) {
+	if h, ok := ctx.Value(routeKey{}).(*routeHolder); ok {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.route, h.explicit = route, true
+	}
+}
+
+// routeLimiter bounds the distinct routes of one Handler.
+type routeLimiter struct {
+	name string
+	max  int
+
+	mu     sync.Mutex
+	issued map[string]struct{}
+	warned bool
+}
+
+func newRouteLimiter(name string, max int) *routeLimiter {
+	if max <= 0 {
+		max = DefaultMaxRoutes
+	}
+	return &routeLimiter{name: name, max: max, issued: map[string]struct{}{}}
+}
+
+// bucket returns the route, or "other" once the cap is reached.
+func (l *routeLimiter) bucket(route string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.issued[route]; !ok {
+		if len(l.issued) >= l.max {
+			if l.warned {
+				return otherRoute
+			}
+			l.warned = true
+			slog.Warn(`labeling route as "other", too many distinct routes`, "handler", l.name, "route", route, "max", l.max)
+			return otherRoute
+		}
+		l.issued[route] = struct{}{}
+	}
+	return route
+}
+
+// routeLabel returns the value of the "route" label for the request.
+func routeLabel(ctx context.Context) string {
+	if h, ok := ctx.Value(routeKey{}).(*routeHolder); ok {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.label
+	}
+	return ""
+}
+
+// withRouteHolder adds the holder for the route to the request context. It
+// must be outside of the instrumentation that reads the route.
+func withRouteHolder(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := &routeHolder{}
+		// A ServeMux around the Handler has already matched the request.
+		h.setPattern(requestPattern(r))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, h)))
+	})
+}
+
+// recordRoute records the pattern with which a ServeMux inside the Handler
+// matched the request, which it sets on the request we pass it, and names
+// the server span after the route.
+func recordRoute(l *routeLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		h, ok := r.Context().Value(routeKey{}).(*routeHolder)
+		if !ok {
+			return
+		}
+		h.setPattern(requestPattern(r))
+
+		h.mu.Lock()
+		route := h.route
+		h.mu.Unlock()
+		if route == "" {
+			return
+		}
+		label := l.bucket(route)
+		h.mu.Lock()
+		h.label = label
+		h.mu.Unlock()
+
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(label)
+		span.SetAttributes(semconv.HTTPRoute(label))
+	})
+}
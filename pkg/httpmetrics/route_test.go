@@ -0,0 +1,127 @@
+//go:build go1.23
+
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// The enhanced ServeMux patterns are off by default in modules before Go 1.22.
+//go:debug httpmuxgo121=0
+
+package httpmetrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// routes returns the values of the "route" label of http_request_status.
+func routes(t *testing.T, reg *prometheus.Registry) map[string]float64 {
+	t.Helper()
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() = %v", err)
+	}
+	got := map[string]float64{}
+	for _, mf := range mfs {
+		if mf.GetName() != "http_request_status" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "route" {
+					got[l.GetValue()] += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return got
+}
+
+func TestHandlerRoute(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := trace.NewTracerProvider(trace.WithSpanProcessor(sr))
+	defer tp.Shutdown(context.Background())
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	reg := prometheus.NewRegistry()
+	m, err := NewMetrics(reg)
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+
+	ok := func(http.ResponseWriter, *http.Request) {}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /items/{id}", ok)
+	mux.HandleFunc("/custom/", func(_ http.ResponseWriter, r *http.Request) {
+		SetRoute(r.Context(), "/custom/{name}")
+	})
+	h := m.Handler("test", mux)
+
+	for _, path := range []string{"/items/1", "/items/2", "/custom/foo", "/missing"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	want := map[string]float64{
+		"GET /items/{id}": 2,
+		"/custom/{name}":  1,
+		"":                1,
+	}
+	if diff := cmp.Diff(want, routes(t, reg)); diff != "" {
+		t.Errorf("routes (-want +got): %s", diff)
+	}
+
+	var names []string
+	for _, s := range sr.Ended() {
+		names = append(names, s.Name())
+	}
+	if diff := cmp.Diff([]string{"GET /items/{id}", "GET /items/{id}", "/custom/{name}", "test"}, names); diff != "" {
+		t.Errorf("span names (-want +got): %s", diff)
+	}
+}
+
+func TestHandlerRouteOutsideMux(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := NewMetrics(reg)
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("POST /events", m.HandlerFunc("events", func(http.ResponseWriter, *http.Request) {}))
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/events", nil))
+
+	if diff := cmp.Diff(map[string]float64{"POST /events": 1}, routes(t, reg)); diff != "" {
+		t.Errorf("routes (-want +got): %s", diff)
+	}
+}
+
+func TestHandlerMaxRoutes(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := NewMetrics(reg)
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	h := m.HandlerFunc("test", func(_ http.ResponseWriter, r *http.Request) {
+		// Don't do this: the path is unbounded.
+		SetRoute(r.Context(), r.URL.Path)
+	}, WithMaxRoutes(2))
+
+	for _, path := range []string{"/a", "/b", "/c", "/d", "/a"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	want := map[string]float64{"/a": 2, "/b": 1, "other": 2}
+	if diff := cmp.Diff(want, routes(t, reg)); diff != "" {
+		t.Errorf("routes (-want +got): %s", diff)
+	}
+}
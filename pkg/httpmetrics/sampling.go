@@ -0,0 +1,120 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kelseyhightower/envconfig"
+	"go.opentelemetry.io/otel/sdk/trace"
+)
+
+// samplerFromEnv returns the sampler configured by the standard
+// OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG environment variables.
+// The short forms "always", "never", "ratio" and "parentbased_ratio" are
+// accepted as well.
+// See https://opentelemetry.io/docs/languages/sdk-configuration/general/#otel_traces_sampler
+func samplerFromEnv() (trace.Sampler, error) {
+	var env struct {
+		Sampler    string `envconfig:"OTEL_TRACES_SAMPLER" default:"parentbased_always_on"`
+		SamplerArg string `envconfig:"OTEL_TRACES_SAMPLER_ARG"`
+	}
+	if err := envconfig.Process("", &env); err != nil {
+		return nil, err
+	}
+
+	ratio := func() (float64, error) {
+		if env.SamplerArg == "" {
+			return 1.0, nil
+		}
+		r, err := strconv.ParseFloat(env.SamplerArg, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parsing OTEL_TRACES_SAMPLER_ARG: %w", err)
+		}
+		if r < 0 || r > 1 {
+			return 0, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG must be in [0, 1], got %v", r)
+		}
+		return r, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(env.Sampler)) {
+	case "always_on", "always":
+		return trace.AlwaysSample(), nil
+	case "always_off", "never":
+		return trace.NeverSample(), nil
+	case "traceidratio", "ratio":
+		r, err := ratio()
+		if err != nil {
+			return nil, err
+		}
+		return trace.TraceIDRatioBased(r), nil
+	case "parentbased_always_on":
+		return trace.ParentBased(trace.AlwaysSample()), nil
+	case "parentbased_always_off":
+		return trace.ParentBased(trace.NeverSample()), nil
+	case "parentbased_traceidratio", "parentbased_ratio":
+		r, err := ratio()
+		if err != nil {
+			return nil, err
+		}
+		return trace.ParentBased(trace.TraceIDRatioBased(r)), nil
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_SAMPLER: %q", env.Sampler)
+	}
+}
+
+type samplerKey struct{}
+
+// WithTraceSampler overrides the sampler installed by SetupTracer for the
+// server spans of this handler, e.g. to drop the spans of noisy health
+// checks with trace.NeverSample().
+func WithTraceSampler(s trace.Sampler) HandlerOption {
+	return func(c *handlerConfig) { c.sampler = s }
+}
+
+// WithTraceSampleRatio is WithTraceSampler with a TraceIDRatioBased sampler.
+func WithTraceSampleRatio(fraction float64) HandlerOption {
+	return WithTraceSampler(trace.TraceIDRatioBased(fraction))
+}
+
+// withSampler makes the sampler available to handlerSampler when the
+// server span of the request is started. The sampler decides for the server
+// span (whether or not it has a remote parent), and the spans started beneath
+// it follow that decision.
+func withSampler(s trace.Sampler, next http.Handler) http.Handler {
+	s = trace.ParentBased(s,
+		trace.WithRemoteParentSampled(s),
+		trace.WithRemoteParentNotSampled(s),
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), samplerKey{}, s)))
+	})
+}
+
+// handlerSampler defers to the sampler of the handler serving the request,
+// if it has one, and otherwise to the fallback sampler.
+type handlerSampler struct {
+	fallback trace.Sampler
+}
+
+var _ trace.Sampler = handlerSampler{}
+
+// ShouldSample implements trace.Sampler
+func (hs handlerSampler) ShouldSample(p trace.SamplingParameters) trace.SamplingResult {
+	if s, ok := p.ParentContext.Value(samplerKey{}).(trace.Sampler); ok {
+		return s.ShouldSample(p)
+	}
+	return hs.fallback.ShouldSample(p)
+}
+
+// Description implements trace.Sampler
+func (hs handlerSampler) Description() string {
+	return fmt.Sprintf("HandlerSampler{%s}", hs.fallback.Description())
+}
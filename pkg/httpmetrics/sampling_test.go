@@ -0,0 +1,81 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSamplerFromEnv(t *testing.T) {
+	for _, c := range []struct {
+		sampler, arg string
+		want         string
+		wantErr      bool
+	}{
+		{"", "", trace.ParentBased(trace.AlwaysSample()).Description(), false},
+		{"always", "", trace.AlwaysSample().Description(), false},
+		{"always_off", "", trace.NeverSample().Description(), false},
+		{"never", "", trace.NeverSample().Description(), false},
+		{"traceidratio", "0.25", trace.TraceIDRatioBased(0.25).Description(), false},
+		{"ratio", "", trace.TraceIDRatioBased(1).Description(), false},
+		{"parentbased_ratio", "0.1", trace.ParentBased(trace.TraceIDRatioBased(0.1)).Description(), false},
+		{"parentbased_always_off", "", trace.ParentBased(trace.NeverSample()).Description(), false},
+		{"ratio", "lots", "", true},
+		{"ratio", "1.5", "", true},
+		{"sometimes", "", "", true},
+	} {
+		t.Run(c.sampler+"/"+c.arg, func(t *testing.T) {
+			if c.sampler != "" {
+				t.Setenv("OTEL_TRACES_SAMPLER", c.sampler)
+			}
+			t.Setenv("OTEL_TRACES_SAMPLER_ARG", c.arg)
+
+			got, err := samplerFromEnv()
+			if (err != nil) != c.wantErr {
+				t.Fatalf("samplerFromEnv() = %v, wantErr %t", err, c.wantErr)
+			}
+			if err == nil && got.Description() != c.want {
+				t.Errorf("samplerFromEnv() = %s, want %s", got.Description(), c.want)
+			}
+		})
+	}
+}
+
+func TestHandlerSampler(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := trace.NewTracerProvider(
+		trace.WithSampler(handlerSampler{fallback: trace.AlwaysSample()}),
+		trace.WithSpanProcessor(sr),
+	)
+	defer tp.Shutdown(context.Background())
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Spans started by the handler follow the server span.
+		_, span := tp.Tracer("test").Start(r.Context(), "child")
+		span.End()
+	})
+	sampled := otelhttp.NewHandler(ok, "sampled", otelhttp.WithTracerProvider(tp))
+	unsampled := withSampler(trace.NeverSample(), otelhttp.NewHandler(ok, "unsampled", otelhttp.WithTracerProvider(tp)))
+
+	for _, h := range []http.Handler{sampled, unsampled} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	var got []string
+	for _, s := range sr.Ended() {
+		got = append(got, s.Name())
+	}
+	if len(got) != 2 || got[0] != "child" || got[1] != "sampled" {
+		t.Errorf("recorded spans = %v, want [child sampled]", got)
+	}
+}
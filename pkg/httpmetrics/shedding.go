@@ -0,0 +1,233 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// LoadSheddingOption configures the load shedding added by WithLoadShedding.
+type LoadSheddingOption func(*sheddingConfig)
+
+type sheddingConfig struct {
+	newLimit   func() limitAlgorithm
+	status     int
+	retryAfter time.Duration
+}
+
+// WithStaticLimit serves at most n requests at once.
+func WithStaticLimit(n int) LoadSheddingOption {
+	return func(c *sheddingConfig) {
+		c.newLimit = func() limitAlgorithm { return staticLimit(n) }
+	}
+}
+
+// initialLimit is where the adaptive limits start, within their bounds.
+const initialLimit = 20
+
+// WithAIMDLimit adapts the limit between min and max with additive increase
+// and multiplicative decrease: the limit grows by one for each request that
+// is served within the timeout while the limit is in use, and shrinks by a
+// tenth for each request that takes longer. It starts at 20, within bounds.
+func WithAIMDLimit(min, max int, timeout time.Duration) LoadSheddingOption {
+	return func(c *sheddingConfig) {
+		c.newLimit = func() limitAlgorithm {
+			return &aimdLimit{limit: initial(min, max), min: float64(min), max: float64(max), timeout: timeout}
+		}
+	}
+}
+
+// WithGradientLimit adapts the limit between min and max to the gradient of
+// the latency: the limit grows while requests are served as quickly as
+// they have been on average, and shrinks as they slow down, which signals
+// that they are queueing for something. It starts at 20, within bounds.
+// See https://github.com/Netflix/concurrency-limits
+func WithGradientLimit(min, max int) LoadSheddingOption {
+	return func(c *sheddingConfig) {
+		c.newLimit = func() limitAlgorithm {
+			return &gradientLimit{limit: initial(min, max), min: float64(min), max: float64(max)}
+		}
+	}
+}
+
+func initial(lo, hi int) float64 {
+	return float64(max(lo, min(hi, initialLimit)))
+}
+
+// WithShedStatusCode sets the status of the responses to shed requests,
+// which is http.StatusServiceUnavailable by default.
+// http.StatusTooManyRequests is the other sensible choice.
+func WithShedStatusCode(code int) LoadSheddingOption {
+	return func(c *sheddingConfig) { c.status = code }
+}
+
+// WithShedRetryAfter sets the Retry-After of the responses to shed
+// requests, which is a second by default.
+func WithShedRetryAfter(d time.Duration) LoadSheddingOption {
+	return func(c *sheddingConfig) { c.retryAfter = d }
+}
+
+// WithLoadShedding caps the number of requests the Handler serves at once,
+// and answers the requests beyond it with a 503 (see WithShedStatusCode)
+// and Retry-After, which Pub/Sub push subscriptions and our clients (see
+// WithRetries) treat as a signal to back off. The limit adapts to the
+// latency of the handler with WithGradientLimit(1, 1000), unless it is
+// configured with WithStaticLimit, WithAIMDLimit or WithGradientLimit.
+//
+// Shed requests are counted by http_requests_shed_total, and not by the
+// other metrics of the Handler.
+func WithLoadShedding(opts ...LoadSheddingOption) HandlerOption {
+	cfg := sheddingConfig{
+		status:     http.StatusServiceUnavailable,
+		retryAfter: time.Second,
+	}
+	WithGradientLimit(1, 1000)(&cfg)
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return func(c *handlerConfig) { c.shedding = &cfg }
+}
+
+func (m *Metrics) newSheddingCollectors() {
+	m.mShed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_shed_total",
+			Help: "The number of requests rejected by the concurrency limit of the handler",
+		},
+		[]string{"handler", "service_name", "configuration_name", "revision_name"},
+	)
+	m.mConcurrencyLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "http_concurrency_limit",
+			Help: "The number of requests the handler serves at once before shedding load",
+		},
+		[]string{"handler", "service_name", "configuration_name", "revision_name"},
+	)
+}
+
+// limitAlgorithm decides the concurrency limit. Its methods are called with
+// the concurrencyLimiter's lock held.
+type limitAlgorithm interface {
+	current() int
+	// update is called as each request completes, with its latency and the
+	// number of requests that were in flight (including it).
+	update(latency time.Duration, inFlight int)
+}
+
+type staticLimit int
+
+func (l staticLimit) current() int              { return int(l) }
+func (l staticLimit) update(time.Duration, int) {}
+
+// aimdBackoff is the factor by which a slow request shrinks the AIMD limit.
+const aimdBackoff = 0.9
+
+type aimdLimit struct {
+	limit, min, max float64
+	timeout         time.Duration
+}
+
+func (l *aimdLimit) current() int { return int(l.limit) }
+
+func (l *aimdLimit) update(latency time.Duration, inFlight int) {
+	switch {
+	case latency > l.timeout:
+		l.limit = max(l.min, l.limit*aimdBackoff)
+	case float64(inFlight)*2 >= l.limit:
+		// Only grow while the limit is in use, or it would grow unbounded
+		// under light load.
+		l.limit = min(l.max, l.limit+1)
+	}
+}
+
+const (
+	// gradientTolerance is how much slower than average requests may be
+	// before the limit shrinks.
+	gradientTolerance = 1.5
+	// gradientSmoothing is the weight of each update to the limit.
+	gradientSmoothing = 0.2
+	// gradientWindow is the number of requests over which the average
+	// latency is taken.
+	gradientWindow = 600
+)
+
+type gradientLimit struct {
+	limit, min, max float64
+
+	// average is the moving average of the latency, in seconds, over the
+	// last gradientWindow requests.
+	average float64
+	samples int
+}
+
+func (l *gradientLimit) current() int { return int(l.limit) }
+
+func (l *gradientLimit) update(latency time.Duration, inFlight int) {
+	s := latency.Seconds()
+	l.samples = min(l.samples+1, gradientWindow)
+	l.average += (s - l.average) / float64(l.samples)
+	if float64(inFlight)*2 < l.limit || s <= 0 {
+		return
+	}
+	gradient := max(0.5, min(1, gradientTolerance*l.average/s))
+	// The square root leaves room for requests to queue, so that the limit
+	// can grow while the latency is steady.
+	next := l.limit*gradient + math.Sqrt(l.limit)
+	l.limit = max(l.min, min(l.max, l.limit*(1-gradientSmoothing)+next*gradientSmoothing))
+}
+
+// concurrencyLimiter admits requests up to the limit of its algorithm.
+type concurrencyLimiter struct {
+	mu       sync.Mutex
+	algo     limitAlgorithm
+	inFlight int
+}
+
+// acquire reports whether a request may be served, in which case release
+// must be called when it completes.
+func (l *concurrencyLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight >= max(l.algo.current(), 1) {
+		return false
+	}
+	l.inFlight++
+	return true
+}
+
+// release records the latency of a request, and returns the new limit.
+func (l *concurrencyLimiter) release(latency time.Duration) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.algo.update(latency, l.inFlight)
+	l.inFlight--
+	return l.algo.current()
+}
+
+func (m *Metrics) shedLoad(cfg *sheddingConfig, labels prometheus.Labels, next http.Handler) http.Handler {
+	l := &concurrencyLimiter{algo: cfg.newLimit()}
+	limit := m.mConcurrencyLimit.With(labels)
+	limit.Set(float64(l.algo.current()))
+	shed := m.mShed.With(labels)
+	retryAfter := strconv.Itoa(int(math.Ceil(cfg.retryAfter.Seconds())))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.acquire() {
+			shed.Inc()
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "too many requests in flight", cfg.status)
+			return
+		}
+		start := time.Now()
+		defer func() { limit.Set(float64(l.release(time.Since(start)))) }()
+		next.ServeHTTP(w, r)
+	})
+}
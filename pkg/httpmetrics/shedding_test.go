@@ -0,0 +1,133 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoadShedding(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	h := m.Handler("shed", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		started <- struct{}{}
+		<-release
+	}), WithLoadShedding(WithStaticLimit(2), WithShedStatusCode(http.StatusTooManyRequests), WithShedRetryAfter(1500*time.Millisecond)))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("admitted request status = %d, want %d", rec.Code, http.StatusOK)
+			}
+		}()
+		<-started
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("shed request status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+	close(release)
+	wg.Wait()
+
+	labels := prometheus.Labels{
+		"handler":            "shed",
+		"service_name":       env.KnativeServiceName,
+		"configuration_name": env.KnativeConfigurationName,
+		"revision_name":      env.KnativeRevisionName,
+	}
+	if got := testutil.ToFloat64(m.mShed.With(labels)); got != 1 {
+		t.Errorf("http_requests_shed_total = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.mConcurrencyLimit.With(labels)); got != 2 {
+		t.Errorf("http_concurrency_limit = %v, want 2", got)
+	}
+	// Shed requests aren't counted with the ones that were served.
+	if got := testutil.CollectAndCount(m.counter); got != 1 {
+		t.Errorf("http_request_status series = %d, want 1", got)
+	}
+
+	// Once the requests complete, there is room again.
+	go func() { <-started }()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestAIMDLimit(t *testing.T) {
+	l := &aimdLimit{limit: 10, min: 5, max: 11, timeout: time.Second}
+
+	// Under light load, the limit holds.
+	l.update(time.Millisecond, 1)
+	if got := l.current(); got != 10 {
+		t.Errorf("limit = %d, want 10", got)
+	}
+	// Under load, it grows up to the max.
+	for i := 0; i < 3; i++ {
+		l.update(time.Millisecond, 10)
+	}
+	if got := l.current(); got != 11 {
+		t.Errorf("limit = %d, want 11", got)
+	}
+	// Slow requests shrink it down to the min.
+	l.update(2*time.Second, 10)
+	if got := l.current(); got != 9 {
+		t.Errorf("limit = %d, want 9", got)
+	}
+	for i := 0; i < 20; i++ {
+		l.update(2*time.Second, 10)
+	}
+	if got := l.current(); got != 5 {
+		t.Errorf("limit = %d, want 5", got)
+	}
+}
+
+func TestGradientLimit(t *testing.T) {
+	l := &gradientLimit{limit: initial(1, 1000), min: 1, max: 1000}
+
+	// While the latency is steady under load, the limit grows.
+	for i := 0; i < 50; i++ {
+		l.update(100*time.Millisecond, l.current())
+	}
+	grown := l.current()
+	if grown <= initialLimit {
+		t.Errorf("limit = %d, want more than %d", grown, initialLimit)
+	}
+	// As requests queue up and slow down, it shrinks.
+	for i := 0; i < 20; i++ {
+		l.update(time.Second, l.current())
+	}
+	if got := l.current(); got >= grown {
+		t.Errorf("limit = %d, want less than %d", got, grown)
+	}
+	// Under light load, it holds.
+	before := l.current()
+	l.update(time.Minute, 1)
+	if got := l.current(); got != before {
+		t.Errorf("limit = %d, want %d", got, before)
+	}
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chainguard-dev/clog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ErrGitHubRateLimited is returned (wrapped) by a transport with
+// WithGitHubThrottling for requests that would exceed GitHub's rate limits,
+// when waiting for the limit to reset would take too long.
+var ErrGitHubRateLimited = errors.New("github rate limit exceeded")
+
+// GitHubThrottleOption configures the throttling added by WithGitHubThrottling.
+type GitHubThrottleOption func(*githubThrottleConfig)
+
+type githubThrottleConfig struct {
+	minRemaining int
+	maxWait      time.Duration
+}
+
+// WithGitHubMinRemaining sets the quota to keep in reserve: requests wait
+// once no more than n requests remain. The default is 0.
+func WithGitHubMinRemaining(n int) GitHubThrottleOption {
+	return func(c *githubThrottleConfig) { c.minRemaining = n }
+}
+
+// WithGitHubMaxWait sets the longest a request waits for a rate limit to
+// reset before failing with ErrGitHubRateLimited. The default is a minute,
+// and 0 always fails fast.
+func WithGitHubMaxWait(d time.Duration) GitHubThrottleOption {
+	return func(c *githubThrottleConfig) { c.maxWait = d }
+}
+
+// WithGitHubThrottling makes WrapTransport track the remaining quota of each
+// GitHub rate limit resource, and hold requests once it nears zero until
+// X-RateLimit-Reset. Secondary rate limits, signaled by Retry-After on a 403
+// or 429, hold all of the requests with the same host and identity (see
+// WithGitHubIdentity). Requests that would wait longer
+// than WithGitHubMaxWait, or past their context's deadline, fail fast with
+// ErrGitHubRateLimited.
+func WithGitHubThrottling(opts ...GitHubThrottleOption) TransportOption {
+	cfg := githubThrottleConfig{
+		maxWait: time.Minute,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return func(c *transportConfig) {
+		c.githubThrottle = &githubThrottler{
+			cfg:       cfg,
+			quotas:    map[githubKey]*githubQuota{},
+			secondary: map[githubKey]time.Time{},
+		}
+	}
+}
+
+func (m *Metrics) newGitHubThrottleCollectors() {
+	m.mGitHubThrottleWait = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_rate_limit_wait_seconds_total",
+			Help: "The time requests spent waiting for GitHub rate limits to reset",
+		},
+		[]string{"host", "identity", "resource"},
+	)
+	m.mGitHubThrottled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_rate_limit_throttled_total",
+			Help: "The number of requests held back by GitHub rate limits, by whether they waited or were rejected",
+		},
+		[]string{"host", "identity", "resource", "outcome"},
+	)
+}
+
+// secondaryResource is the resource under which secondary rate limits, which
+// apply across resources, are recorded.
+const secondaryResource = "secondary"
+
+type githubQuota struct {
+	remaining int
+	reset     time.Time
+}
+
+// githubThrottler tracks the rate limits seen in responses from GitHub, for
+// each host and identity.
+type githubThrottler struct {
+	cfg githubThrottleConfig
+
+	mu     sync.Mutex
+	quotas map[githubKey]*githubQuota
+	// secondary holds the end of the secondary rate limits, by host and
+	// identity (with secondaryResource).
+	secondary map[githubKey]time.Time
+}
+
+// githubResource guesses the rate limit resource of a request before GitHub
+// tells us with X-RateLimit-Resource.
+// See https://docs.github.com/en/rest/rate-limit/rate-limit#get-rate-limit-status-for-the-authenticated-user
+func githubResource(r *http.Request) string {
+	p := githubAPIPath(r)
+	switch {
+	case p == "/graphql":
+		return "graphql"
+	case strings.HasPrefix(p, "/search/code"):
+		return "code_search"
+	case strings.HasPrefix(p, "/search/"):
+		return "search"
+	default:
+		return "core"
+	}
+}
+
+// admit returns how long the request must wait before it may be sent, and
+// the budget that holds it back. It optimistically takes one request from
+// the remaining quota, so that concurrent requests don't overshoot it.
+func (t *githubThrottler) admit(key githubKey, now time.Time) (time.Duration, githubKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sk := githubKey{host: key.host, identity: key.identity, resource: secondaryResource}
+	if until, ok := t.secondary[sk]; ok {
+		if now.Before(until) {
+			return until.Sub(now), sk
+		}
+		delete(t.secondary, sk)
+	}
+	q, ok := t.quotas[key]
+	if !ok || !now.Before(q.reset) {
+		return 0, key
+	}
+	if q.remaining <= t.cfg.minRemaining {
+		return q.reset.Sub(now), key
+	}
+	q.remaining--
+	return 0, key
+}
+
+// maxGitHubBudgets bounds the memory used to track rate limits.
+const maxGitHubBudgets = 1000
+
+// prune forgets the rate limits that have reset, or all of them if none
+// have. It is called with the lock held.
+func (t *githubThrottler) prune(now time.Time) {
+	for k, q := range t.quotas {
+		if !now.Before(q.reset) {
+			delete(t.quotas, k)
+		}
+	}
+	for k, until := range t.secondary {
+		if !now.Before(until) {
+			delete(t.secondary, k)
+		}
+	}
+	if len(t.quotas)+len(t.secondary) >= maxGitHubBudgets {
+		clear(t.quotas)
+		clear(t.secondary)
+	}
+}
+
+// observe updates the rate limits of the identity from the response to a
+// request. The request is passed in, as transports need not set
+// resp.Request.
+func (t *githubThrottler) observe(r *http.Request, identity string, resp *http.Response, now time.Time) {
+	host := r.URL.Host
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.quotas)+len(t.secondary) >= maxGitHubBudgets {
+		t.prune(now)
+	}
+
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests {
+		if d, ok := retryAfter(resp); ok {
+			t.secondary[githubKey{host: host, identity: identity, resource: secondaryResource}] = now.Add(d)
+		}
+	}
+
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+	resource := resp.Header.Get("X-RateLimit-Resource")
+	if resource == "" {
+		resource = githubResource(r)
+	}
+	t.quotas[githubKey{host: host, identity: identity, resource: resource}] = &githubQuota{
+		remaining: remaining,
+		reset:     time.Unix(reset, 0),
+	}
+}
+
+func (m *Metrics) instrumentGitHubThrottling(c githubConfig, t *githubThrottler, next http.RoundTripper) promhttp.RoundTripperFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		if !c.isGitHubAPI(r) {
+			return next.RoundTrip(r)
+		}
+		ctx := r.Context()
+		identity := c.identity(r)
+		key := githubKey{host: r.URL.Host, identity: identity, resource: githubResource(r)}
+		for {
+			wait, held := t.admit(key, time.Now())
+			if wait <= 0 {
+				break
+			}
+			labels := held.labels()
+			labels["identity"] = m.githubIdentities.label(held.identity)
+			log := clog.FromContext(ctx).With("host", held.host, "identity", labels["identity"], "resource", held.resource, "wait", wait.Round(time.Second))
+			if wait > t.cfg.maxWait || !hasTimeFor(ctx, wait) {
+				labels["outcome"] = "rejected"
+				m.mGitHubThrottled.With(labels).Inc()
+				log.WarnContext(ctx, "Rejecting request, GitHub rate limit exhausted")
+				return nil, fmt.Errorf("%w: %s quota exhausted for %v", ErrGitHubRateLimited, held.resource, wait.Round(time.Second))
+			}
+			log.InfoContext(ctx, "Holding request until GitHub rate limit resets")
+			start := time.Now()
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+			case <-timer.C:
+			}
+			m.mGitHubThrottleWait.With(labels).Add(time.Since(start).Seconds())
+			labels["outcome"] = "waited"
+			m.mGitHubThrottled.With(labels).Inc()
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := next.RoundTrip(r)
+		if err == nil {
+			t.observe(r, identity, resp, time.Now())
+		}
+		return resp, err
+	}
+}
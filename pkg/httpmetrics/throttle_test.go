@@ -0,0 +1,216 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeGitHub responds to every request with the status and headers.
+func fakeGitHub(calls *int, status int, headers map[string]string) http.RoundTripper {
+	return promhttp.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		*calls++
+		resp := &http.Response{
+			StatusCode: status,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("")),
+			Request:    r,
+		}
+		for k, v := range headers {
+			resp.Header.Set(k, v)
+		}
+		return resp, nil
+	})
+}
+
+func TestGitHubThrottlerAdmit(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	th := &githubThrottler{
+		cfg:       githubThrottleConfig{minRemaining: 1},
+		quotas:    map[githubKey]*githubQuota{},
+		secondary: map[githubKey]time.Time{},
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://api.github.com/search/issues", nil)
+	th.observe(req, "app", &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"X-Ratelimit-Remaining": {"2"},
+			"X-Ratelimit-Reset":     {fmt.Sprint(now.Add(time.Minute).Unix())},
+		},
+	}, now)
+
+	search := githubKey{host: "api.github.com", identity: "app", resource: "search"}
+	// Resources and identities are tracked separately.
+	for _, k := range []githubKey{
+		{host: "api.github.com", identity: "app", resource: "core"},
+		{host: "api.github.com", identity: "other-app", resource: "search"},
+	} {
+		if wait, _ := th.admit(k, now); wait != 0 {
+			t.Errorf("admit(%v) = %v, want 0", k, wait)
+		}
+	}
+	// One request is left before the reserve of 1 is reached.
+	if wait, _ := th.admit(search, now); wait != 0 {
+		t.Errorf("admit(search) = %v, want 0", wait)
+	}
+	if wait, held := th.admit(search, now); wait != time.Minute || held != search {
+		t.Errorf("admit(search) = %v, %v, want 1m0s, %v", wait, held, search)
+	}
+	// Once the window resets, requests go through again.
+	if wait, _ := th.admit(search, now.Add(time.Minute)); wait != 0 {
+		t.Errorf("admit(search) after reset = %v, want 0", wait)
+	}
+}
+
+func TestGitHubThrottlingRejects(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	var calls int
+	client := &http.Client{Transport: m.WrapTransport(fakeGitHub(&calls, http.StatusForbidden, map[string]string{
+		"X-RateLimit-Remaining": "0",
+		"X-RateLimit-Reset":     fmt.Sprint(time.Now().Add(time.Hour).Unix()),
+		"X-RateLimit-Resource":  "core",
+	}), WithGitHubThrottling(), WithRetries())}
+
+	resp, err := client.Get("https://api.github.com/repos/chainguard-dev/terraform-infra-common")
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	resp.Body.Close()
+
+	// The quota is exhausted for an hour, so the next request fails fast.
+	if _, err := client.Get("https://api.github.com/repos/chainguard-dev/terraform-infra-common"); !errors.Is(err, ErrGitHubRateLimited) {
+		t.Errorf("Get() = %v, want %v", err, ErrGitHubRateLimited)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+	if got := testutil.ToFloat64(m.mGitHubThrottled.With(prometheus.Labels{"host": "api.github.com", "identity": "", "resource": "core", "outcome": "rejected"})); got != 1 {
+		t.Errorf("rejected = %v, want 1", got)
+	}
+}
+
+func TestGitHubThrottlingWithoutResponseRequest(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	var calls int
+	// Unlike fakeGitHub, this transport leaves resp.Request unset, and GitHub
+	// doesn't name the resource, so it is guessed from the request.
+	client := &http.Client{Transport: m.WrapTransport(promhttp.RoundTripperFunc(func(*http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"X-Ratelimit-Remaining": {"0"},
+				"X-Ratelimit-Reset":     {fmt.Sprint(time.Now().Add(time.Hour).Unix())},
+			},
+			Body: io.NopCloser(strings.NewReader("")),
+		}, nil
+	}), WithGitHubThrottling())}
+
+	resp, err := client.Get("https://api.github.com/search/issues?q=is:open")
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	resp.Body.Close()
+
+	// The search quota is exhausted, but not the core one.
+	if _, err := client.Get("https://api.github.com/search/commits?q=throttle"); !errors.Is(err, ErrGitHubRateLimited) {
+		t.Errorf("Get() = %v, want %v", err, ErrGitHubRateLimited)
+	}
+	resp, err = client.Get("https://api.github.com/repos/chainguard-dev/terraform-infra-common")
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	resp.Body.Close()
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+}
+
+func TestGitHubThrottlingSecondary(t *testing.T) {
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	var calls int
+	client := &http.Client{Transport: m.WrapTransport(fakeGitHub(&calls, http.StatusForbidden, map[string]string{
+		"Retry-After": "1",
+	}), WithGitHubThrottling())}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("https://api.github.com/graphql")
+		if err != nil {
+			t.Fatalf("Get() = %v", err)
+		}
+		resp.Body.Close()
+	}
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+	if got := testutil.ToFloat64(m.mGitHubThrottled.With(prometheus.Labels{"host": "api.github.com", "identity": "", "resource": secondaryResource, "outcome": "waited"})); got != 1 {
+		t.Errorf("waited = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.mGitHubThrottleWait); got < .5 {
+		t.Errorf("wait seconds = %v, want ~1", got)
+	}
+
+	// Other hosts aren't throttled.
+	var other int
+	client = &http.Client{Transport: m.WrapTransport(fakeGitHub(&other, http.StatusForbidden, map[string]string{
+		"Retry-After": "60",
+	}), WithGitHubThrottling())}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("https://example.com/")
+		if err != nil {
+			t.Fatalf("Get() = %v", err)
+		}
+		resp.Body.Close()
+	}
+	if other != 2 {
+		t.Errorf("calls = %d, want 2", other)
+	}
+}
+
+func TestGitHubThrottlerBounded(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	th := &githubThrottler{
+		quotas:    map[githubKey]*githubQuota{},
+		secondary: map[githubKey]time.Time{},
+	}
+	observe := func(identity string, now time.Time) {
+		req, _ := http.NewRequest(http.MethodGet, "https://api.github.com/repos/a/b", nil)
+		th.observe(req, identity, &http.Response{
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"X-Ratelimit-Remaining": {"10"},
+				"X-Ratelimit-Reset":     {fmt.Sprint(now.Add(time.Minute).Unix())},
+			},
+		}, now)
+	}
+	for i := 0; i < maxGitHubBudgets; i++ {
+		observe(fmt.Sprint("token-", i), now)
+	}
+	// Once full, the rate limits that have reset are forgotten.
+	observe("new", now.Add(time.Hour))
+	if got := len(th.quotas); got != 1 {
+		t.Errorf("quotas = %d, want 1", got)
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// WithConnectionTrace makes WrapTransport time the phases of each request
+// with an httptrace.ClientTrace: the DNS lookup, connect and TLS handshake
+// of new connections, and the time to the first byte of the response once
+// the request is written. It also counts whether connections were reused.
+func WithConnectionTrace() TransportOption {
+	return func(c *transportConfig) { c.connTrace = true }
+}
+
+func (m *Metrics) newTraceCollectors() {
+	m.mReqConns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_client_connections_total",
+			Help: "The number of connections used by HTTP requests, by whether they were reused from the pool",
+		},
+		[]string{"host", "reused", "service_name", "configuration_name", "revision_name"},
+	)
+}
+
+func (m *Metrics) instrumentRoundTripperTrace(b *HostBucketer, next http.RoundTripper) promhttp.RoundTripperFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		m.mustInitHistograms()
+		ctx := r.Context()
+		host := b.Bucket(r.URL.Host)
+		labels := prometheus.Labels{
+			"host":               host,
+			"service_name":       env.KnativeServiceName,
+			"configuration_name": env.KnativeConfigurationName,
+			"revision_name":      env.KnativeRevisionName,
+		}
+		observe := func(h *prometheus.HistogramVec, start time.Time) {
+			observeWithExemplar(ctx, h.With(labels), time.Since(start).Seconds())
+		}
+
+		// The hooks may be called concurrently, e.g. when dialing several
+		// addresses of a host.
+		var (
+			mu           sync.Mutex
+			dnsStart     time.Time
+			connectStart = map[string]time.Time{}
+			tlsStart     time.Time
+			wrote        time.Time
+		)
+		trace := &httptrace.ClientTrace{
+			DNSStart: func(httptrace.DNSStartInfo) {
+				mu.Lock()
+				defer mu.Unlock()
+				dnsStart = time.Now()
+			},
+			DNSDone: func(info httptrace.DNSDoneInfo) {
+				mu.Lock()
+				defer mu.Unlock()
+				if info.Err == nil && !dnsStart.IsZero() {
+					observe(m.mReqDNS, dnsStart)
+				}
+			},
+			ConnectStart: func(network, addr string) {
+				mu.Lock()
+				defer mu.Unlock()
+				connectStart[network+addr] = time.Now()
+			},
+			ConnectDone: func(network, addr string, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if start, ok := connectStart[network+addr]; ok && err == nil {
+					observe(m.mReqConnect, start)
+				}
+			},
+			TLSHandshakeStart: func() {
+				mu.Lock()
+				defer mu.Unlock()
+				tlsStart = time.Now()
+			},
+			TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if err == nil && !tlsStart.IsZero() {
+					observe(m.mReqTLS, tlsStart)
+				}
+			},
+			GotConn: func(info httptrace.GotConnInfo) {
+				m.mReqConns.With(prometheus.Labels{
+					"host":               host,
+					"reused":             strconv.FormatBool(info.Reused),
+					"service_name":       env.KnativeServiceName,
+					"configuration_name": env.KnativeConfigurationName,
+					"revision_name":      env.KnativeRevisionName,
+				}).Inc()
+			},
+			WroteRequest: func(info httptrace.WroteRequestInfo) {
+				mu.Lock()
+				defer mu.Unlock()
+				if info.Err == nil {
+					wrote = time.Now()
+				}
+			},
+			GotFirstResponseByte: func() {
+				mu.Lock()
+				defer mu.Unlock()
+				if !wrote.IsZero() {
+					observe(m.mReqTTFB, wrote)
+				}
+			},
+		}
+		return next.RoundTrip(r.WithContext(httptrace.WithClientTrace(ctx, trace)))
+	}
+}
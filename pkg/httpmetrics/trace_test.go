@@ -0,0 +1,71 @@
+/*
+Copyright 2024 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package httpmetrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConnectionTrace(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "ok") //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	client := &http.Client{Transport: m.WrapTransport(srv.Client().Transport, WithConnectionTrace())}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("Get() = %v", err)
+		}
+		if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+			t.Fatalf("reading response body: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	labels := prometheus.Labels{
+		"host":               otherBucket,
+		"service_name":       env.KnativeServiceName,
+		"configuration_name": env.KnativeConfigurationName,
+		"revision_name":      env.KnativeRevisionName,
+	}
+	// The second request reuses the connection of the first.
+	for _, reused := range []string{"true", "false"} {
+		labels["reused"] = reused
+		if got := testutil.ToFloat64(m.mReqConns.With(labels)); got != 1 {
+			t.Errorf("http_client_connections_total{reused=%q} = %v, want 1", reused, got)
+		}
+	}
+	for name, c := range map[string]struct {
+		h    *prometheus.HistogramVec
+		want uint64
+	}{
+		// The server is dialed by IP, so there is no DNS lookup.
+		"http_client_dns_duration_seconds":       {m.mReqDNS, 0},
+		"http_client_connect_duration_seconds":   {m.mReqConnect, 1},
+		"http_client_tls_duration_seconds":       {m.mReqTLS, 1},
+		"http_client_time_to_first_byte_seconds": {m.mReqTTFB, 2},
+	} {
+		if c.want == 0 {
+			if n := testutil.CollectAndCount(c.h); n != 0 {
+				t.Errorf("%s series = %d, want none", name, n)
+			}
+		} else if got := sampleCount(t, c.h); got != c.want {
+			t.Errorf("%s count = %d, want %d", name, got, c.want)
+		}
+	}
+}
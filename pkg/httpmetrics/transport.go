@@ -3,123 +3,165 @@ package httpmetrics
 import (
 	"fmt"
 	"log/slog"
-	"math"
 	"net/http"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 const CeTypeHeader string = "ce-type"
 
-var (
-	mReqCount = promauto.NewCounterVec(
+func (m *Metrics) newClientCollectors() {
+	m.mReqCount = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "http_client_request_count",
 			Help: "The total number of HTTP requests",
 		},
-		[]string{"code", "method", "host", "service_name", "configuration_name", "revision_name", "ce_type"},
+		[]string{"code", "method", "host", "service_name", "configuration_name", "revision_name", "ce_type", "operation"},
 	)
-	mReqInFlight = promauto.NewGaugeVec(
+	m.mReqInFlight = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "http_client_request_in_flight",
 			Help: "The number of outgoing HTTP requests currently inflight",
 		},
-		[]string{"method", "host", "service_name", "configuration_name", "revision_name", "ce_type"},
+		[]string{"method", "host", "service_name", "configuration_name", "revision_name", "ce_type", "operation"},
 	)
-	mReqDuration = promauto.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "http_client_request_duration_seconds",
-			Help:    "The duration of HTTP requests",
-			Buckets: []float64{.25, .5, 1, 2.5, 5, 10, 20, 30, 45, 60},
-		},
-		[]string{"code", "method", "host", "service_name", "configuration_name", "revision_name", "ce_type"},
-	)
-	seenHostMap = make(map[string]int)
-)
+}
+
+// DefaultHostBucketer buckets hosts for WrapTransport, unless another is
+// given with WithHostBucketer. Its rules come from the environment (see
+// HostBucketerFromEnv), SetBuckets and SetBucketSuffixes.
+var DefaultHostBucketer = newDefaultHostBucketer()
+
+func newDefaultHostBucketer() *HostBucketer {
+	b, err := HostBucketerFromEnv()
+	if err != nil {
+		slog.Warn("Failed to load host bucket rules", "error", err)
+		b, _ = NewHostBucketer(nil)
+	}
+	return b
+}
 
-var buckets = map[string]string{}
-var bucketSuffixes = map[string]string{}
+// SetBuckets replaces the exact host rules of the DefaultHostBucketer.
+func SetBuckets(b map[string]string) { setRules(RuleExact, b) }
 
-func SetBuckets(b map[string]string)         { buckets = b }
-func SetBucketSuffixes(bs map[string]string) { bucketSuffixes = bs }
+// SetBucketSuffixes replaces the host suffix rules of the DefaultHostBucketer.
+func SetBucketSuffixes(bs map[string]string) { setRules(RuleSuffix, bs) }
+
+func setRules(kind HostBucketRuleKind, m map[string]string) {
+	if err := DefaultHostBucketer.replaceKind(kind, m); err != nil {
+		// Exact and suffix rules always compile.
+		slog.Error("Failed to set host bucket rules", "kind", kind, "error", err)
+	}
+}
 
 // Transport is an http.RoundTripper that records metrics for each request.
 var Transport = WrapTransport(http.DefaultTransport)
 
-// WrapTransport wraps an http.RoundTripper with instrumentation.
-func WrapTransport(t http.RoundTripper) http.RoundTripper {
-	return instrumentRoundTripperCounter(
-		instrumentRoundTripperInFlight(
-			instrumentRoundTripperDuration(
-				instrumentGitHubRateLimits(
-					otelhttp.NewTransport(t)))))
+// TransportOption configures the instrumentation added by WrapTransport.
+type TransportOption func(*transportConfig)
+
+type transportConfig struct {
+	bucketer       *HostBucketer
+	retries        *retryConfig
+	github         githubConfig
+	githubThrottle *githubThrottler
+	connTrace      bool
+	operations     operationAllowlist
 }
 
-func mapErrorToLabel(err error) string {
-	if strings.Contains(err.Error(), "no route to host") {
-		return "no-route-to_host"
+func newTransportConfig(opts []TransportOption) transportConfig {
+	cfg := transportConfig{
+		bucketer: DefaultHostBucketer,
 	}
-	if strings.Contains(err.Error(), "i/o timeout") {
-		return "io-timeout"
+	for _, opt := range opts {
+		opt(&cfg)
 	}
-	if strings.Contains(err.Error(), "TLS handshake timeout") {
-		return "tls-handshake-timeout"
+	return cfg
+}
+
+// WithHostBucketer sets the HostBucketer used for the "host" label.
+func WithHostBucketer(b *HostBucketer) TransportOption {
+	return func(c *transportConfig) { c.bucketer = b }
+}
+
+// WrapTransport wraps an http.RoundTripper with instrumentation. Retries,
+// throttling and failed requests are logged with a clog logger whose lines
+// Cloud Logging correlates with the client span, see Handler. The requests
+// passed to t carry that logger too.
+func WrapTransport(t http.RoundTripper, opts ...TransportOption) http.RoundTripper {
+	return defaultMetrics.WrapTransport(t, opts...)
+}
+
+// WrapTransport wraps an http.RoundTripper with instrumentation.
+func (m *Metrics) WrapTransport(t http.RoundTripper, opts ...TransportOption) http.RoundTripper {
+	cfg := newTransportConfig(opts)
+	if cfg.connTrace {
+		t = m.instrumentRoundTripperTrace(cfg.bucketer, t)
 	}
-	if strings.Contains(err.Error(), "TLS handshake error") {
-		return "tls-handshake-error"
+	var rt http.RoundTripper = m.instrumentRoundTripperCounter(cfg.bucketer, cfg.operations,
+		m.instrumentRoundTripperInFlight(cfg.bucketer, cfg.operations,
+			m.instrumentRoundTripperDuration(cfg.bucketer, cfg.operations,
+				m.instrumentRoundTripperSize(cfg.bucketer,
+					m.instrumentGitHubRateLimits(cfg.github,
+						m.instrumentRateLimits(cfg.bucketer, t))))))
+	if cfg.githubThrottle != nil {
+		rt = m.instrumentGitHubThrottling(cfg.github, cfg.githubThrottle, rt)
 	}
-	if strings.Contains(err.Error(), "unexpected EOF") {
-		return "unexpected-eof"
+	// Each attempt is counted and timed on its own.
+	if cfg.retries != nil {
+		rt = m.instrumentRoundTripperRetries(cfg.retries, cfg.bucketer, rt)
 	}
-	return "unknown-error"
+	// The span is started outermost, so that the metrics below can attach
+	// its trace ID as an exemplar.
+	return otelhttp.NewTransport(traceLoggerTransport(rt))
 }
 
 // These instrument methods based on promhttp, with bucketized host and Knative labels added:
 // https://pkg.go.dev/github.com/prometheus/client_golang/prometheus/promhttp
 
-func instrumentRoundTripperCounter(next http.RoundTripper) promhttp.RoundTripperFunc {
+func (m *Metrics) instrumentRoundTripperCounter(b *HostBucketer, ops operationAllowlist, next http.RoundTripper) promhttp.RoundTripperFunc {
 	return func(r *http.Request) (*http.Response, error) {
 		resp, err := next.RoundTrip(r)
 		if err == nil {
-			mReqCount.With(prometheus.Labels{
+			m.mReqCount.With(prometheus.Labels{
 				"code":               fmt.Sprintf("%d", resp.StatusCode),
 				"method":             r.Method,
-				"host":               bucketize(r.URL.Host),
+				"host":               b.Bucket(r.URL.Host),
 				"service_name":       env.KnativeServiceName,
 				"configuration_name": env.KnativeConfigurationName,
 				"revision_name":      env.KnativeRevisionName,
 				"ce_type":            r.Header.Get(CeTypeHeader),
+				"operation":          ops.label(r),
 			}).Inc()
 		} else {
-			mReqCount.With(prometheus.Labels{
+			m.mReqCount.With(prometheus.Labels{
 				"code":               mapErrorToLabel(err),
 				"method":             r.Method,
-				"host":               bucketize(r.URL.Host),
+				"host":               b.Bucket(r.URL.Host),
 				"service_name":       env.KnativeServiceName,
 				"configuration_name": env.KnativeConfigurationName,
 				"revision_name":      env.KnativeRevisionName,
 				"ce_type":            r.Header.Get(CeTypeHeader),
+				"operation":          ops.label(r),
 			}).Inc()
 		}
 		return resp, err
 	}
 }
 
-func instrumentRoundTripperInFlight(next http.RoundTripper) promhttp.RoundTripperFunc {
+func (m *Metrics) instrumentRoundTripperInFlight(b *HostBucketer, ops operationAllowlist, next http.RoundTripper) promhttp.RoundTripperFunc {
 	return func(r *http.Request) (*http.Response, error) {
-		g := mReqInFlight.With(prometheus.Labels{
+		g := m.mReqInFlight.With(prometheus.Labels{
 			"method":             r.Method,
-			"host":               bucketize(r.URL.Host),
+			"host":               b.Bucket(r.URL.Host),
 			"service_name":       env.KnativeServiceName,
 			"configuration_name": env.KnativeConfigurationName,
 			"revision_name":      env.KnativeRevisionName,
 			"ce_type":            r.Header.Get(CeTypeHeader),
+			"operation":          ops.label(r),
 		})
 		g.Inc()
 		defer g.Dec()
@@ -127,125 +169,31 @@ func instrumentRoundTripperInFlight(next http.RoundTripper) promhttp.RoundTrippe
 	}
 }
 
-func instrumentRoundTripperDuration(next http.RoundTripper) promhttp.RoundTripperFunc {
+func (m *Metrics) instrumentRoundTripperDuration(b *HostBucketer, ops operationAllowlist, next http.RoundTripper) promhttp.RoundTripperFunc {
 	return func(r *http.Request) (*http.Response, error) {
+		m.mustInitHistograms()
 		start := time.Now()
 		resp, err := next.RoundTrip(r)
+		var code string
 		if err == nil {
-			mReqDuration.With(prometheus.Labels{
-				"code":               fmt.Sprintf("%d", resp.StatusCode),
-				"method":             r.Method,
-				"host":               bucketize(r.URL.Host),
-				"service_name":       env.KnativeServiceName,
-				"configuration_name": env.KnativeConfigurationName,
-				"revision_name":      env.KnativeRevisionName,
-				"ce_type":            r.Header.Get(CeTypeHeader),
-			}).Observe(time.Since(start).Seconds())
+			code = fmt.Sprintf("%d", resp.StatusCode)
+		} else {
+			code = mapErrorToLabel(err)
 		}
+		observeWithExemplar(r.Context(), m.mReqDuration.With(prometheus.Labels{
+			"code":               code,
+			"method":             r.Method,
+			"host":               b.Bucket(r.URL.Host),
+			"service_name":       env.KnativeServiceName,
+			"configuration_name": env.KnativeConfigurationName,
+			"revision_name":      env.KnativeRevisionName,
+			"ce_type":            r.Header.Get(CeTypeHeader),
+			"operation":          ops.label(r),
+		}), time.Since(start).Seconds())
 		return resp, err
 	}
 }
 
 func bucketize(host string) string {
-	// Check the exact matches first.
-	if b, ok := buckets[host]; ok {
-		return b
-	}
-	// Then check the suffixes.
-	for k, v := range bucketSuffixes {
-		if strings.HasSuffix(host, "."+k) {
-			return v
-		}
-	}
-	if math.Mod(float64(seenHostMap[host]), 10) == 0 {
-		seenHostMap[host]++
-		slog.Warn(`bucketing host as "other", use httpmetrics.SetBucket{Suffixe}s`, "host", host, "seen", seenHostMap[host])
-	}
-	return "other"
-}
-
-var (
-	mGitHubRateLimitRemaining = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_remaining",
-			Help: "The number of requests remaining in the current rate limit window",
-		},
-		[]string{"resource"},
-	)
-	mGitHubRateLimit = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit",
-			Help: "The number of requests allowed during the rate limit window",
-		},
-		[]string{"resource"},
-	)
-	mGitHubRateLimitReset = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_reset",
-			Help: "The timestamp at which the current rate limit window resets",
-		},
-		[]string{"resource"},
-	)
-	mGitHubRateLimitUsed = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_used",
-			Help: "The fraction of the rate limit window used",
-		},
-		[]string{"resource"},
-	)
-	mGitHubRateLimitTimeToReset = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "github_rate_limit_time_to_reset",
-			Help: "The number of minutes until the current rate limit window resets",
-		},
-		[]string{"resource"},
-	)
-)
-
-// instrumentGitHubRateLimits is a promhttp.RoundTripperFunc that records GitHub rate limit metrics.
-// See https://docs.github.com/en/rest/using-the-rest-api/rate-limits-for-the-rest-api?apiVersion=2022-11-28
-func instrumentGitHubRateLimits(next http.RoundTripper) promhttp.RoundTripperFunc {
-	return func(r *http.Request) (*http.Response, error) {
-		resp, err := next.RoundTrip(r)
-		if err != nil {
-			return resp, err
-		}
-		if r.URL.Host == "api.github.com" {
-			resource := resp.Header.Get("X-RateLimit-Resource")
-			if resource == "" {
-				resource = "unknown"
-			}
-
-			val := func(key string) float64 {
-				val := resp.Header.Get(key)
-				if val == "" {
-					return 0
-				}
-				i, err := strconv.Atoi(val)
-				if err != nil {
-					return 0
-				}
-				return float64(i)
-			}
-			remaining := val("X-RateLimit-Remaining")
-			mGitHubRateLimitRemaining.With(prometheus.Labels{"resource": resource}).Set(remaining)
-
-			limit := val("X-RateLimit-Limit")
-			mGitHubRateLimit.With(prometheus.Labels{"resource": resource}).Set(limit)
-
-			reset := val("X-RateLimit-Reset")
-			mGitHubRateLimitReset.With(prometheus.Labels{"resource": resource}).Set(reset)
-
-			if limit > 0 {
-				used := (limit - remaining) / limit
-				mGitHubRateLimitUsed.With(prometheus.Labels{"resource": resource}).Set(used)
-			}
-
-			if reset > 0 {
-				timeToReset := time.Until(time.Unix(int64(reset), 0)).Minutes()
-				mGitHubRateLimitTimeToReset.With(prometheus.Labels{"resource": resource}).Set(timeToReset)
-			}
-		}
-		return resp, err
-	}
+	return DefaultHostBucketer.Bucket(host)
 }
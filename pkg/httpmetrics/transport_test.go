@@ -1,8 +1,10 @@
 package httpmetrics
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -15,7 +17,11 @@ func TestTransport(t *testing.T) {
 	}))
 	defer s.Close()
 
-	resp, err := (&http.Client{Transport: Transport}).Get(s.URL)
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	resp, err := (&http.Client{Transport: m.WrapTransport(http.DefaultTransport)}).Get(s.URL)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -24,7 +30,7 @@ func TestTransport(t *testing.T) {
 	}
 
 	// Sample a metric to make sure labels are being properly applied.
-	if got := testutil.ToFloat64(mReqCount.MustCurryWith(prometheus.Labels{
+	if got := testutil.ToFloat64(m.mReqCount.MustCurryWith(prometheus.Labels{
 		"method": "get",
 		"code":   "200",
 		"host":   "other",
@@ -32,3 +38,83 @@ func TestTransport(t *testing.T) {
 		t.Errorf("want metric count = 1, got %f", got)
 	}
 }
+
+func TestWithHostBucketer(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer s.Close()
+
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	b, err := NewHostBucketer([]HostBucketRule{{Kind: RuleExact, Pattern: strings.TrimPrefix(s.URL, "http://"), Bucket: "test server"}})
+	if err != nil {
+		t.Fatalf("NewHostBucketer() = %v", err)
+	}
+	resp, err := (&http.Client{Transport: m.WrapTransport(http.DefaultTransport, WithHostBucketer(b))}).Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got := testutil.ToFloat64(m.mReqCount.MustCurryWith(prometheus.Labels{
+		"method": "get",
+		"code":   "200",
+		"host":   "test server",
+	})); got != 1 {
+		t.Errorf("want metric count = 1, got %f", got)
+	}
+}
+
+func TestWithOperation(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer s.Close()
+
+	m, err := NewMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("NewMetrics() = %v", err)
+	}
+	client := &http.Client{Transport: m.WrapTransport(http.DefaultTransport, WithOperations("list-pulls", "create-check-run"))}
+	for _, op := range []string{"list-pulls", "list-pulls", "create-check-run", "unlisted", ""} {
+		ctx := context.Background()
+		if op != "" {
+			ctx = WithOperation(ctx, op)
+		}
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Do() = %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	for op, want := range map[string]float64{
+		"list-pulls":       2,
+		"create-check-run": 1,
+		// Operations that aren't allowlisted are bucketed.
+		"other": 1,
+		"":      1,
+	} {
+		if got := testutil.ToFloat64(m.mReqCount.With(prometheus.Labels{
+			"code":               "200",
+			"method":             http.MethodGet,
+			"host":               otherBucket,
+			"service_name":       env.KnativeServiceName,
+			"configuration_name": env.KnativeConfigurationName,
+			"revision_name":      env.KnativeRevisionName,
+			"ce_type":            "",
+			"operation":          op,
+		})); got != want {
+			t.Errorf("http_client_request_count{operation=%q} = %v, want %v", op, got, want)
+		}
+	}
+	// The in-flight gauge and the duration are labeled the same way.
+	for name, c := range map[string]prometheus.Collector{
+		"http_client_request_in_flight":        m.mReqInFlight,
+		"http_client_request_duration_seconds": m.mReqDuration,
+	} {
+		if got := testutil.CollectAndCount(c); got != 4 {
+			t.Errorf("%s series = %d, want 4", name, got)
+		}
+	}
+}